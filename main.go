@@ -1,44 +1,119 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"github.com/stenic/regclean/pkg/auth"
-	"github.com/stenic/regclean/pkg/helpers"
-	"github.com/stenic/regclean/pkg/ui"
-	"github.com/stenic/regclean/pkg/utils"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/stenic/regclean/pkg/auth"
+	"github.com/stenic/regclean/pkg/helpers"
+	"github.com/stenic/regclean/pkg/ui"
+	"github.com/stenic/regclean/pkg/utils"
 	"k8s.io/client-go/util/homedir"
 	"k8s.io/utils/strings/slices"
 )
 
 var (
 	kubeContexts       []string
+	contextsSet        bool
 	registryURL        string
 	registryUsername   string
 	registryPassword   string
+	registryToken      string
 	kubeconfig         string
 	v                  string
 	logCaller          bool
 	dryRun             bool
 	yolo               bool
 	minAge             int
+	keepLast           int
+	keepSemverMinors   int
 	excludeNameFilters []string
 	includeNameFilters []string
+	excludeRepoFilters []string
+	includeRepoFilters []string
+	excludeTagFilters  []string
+	includeTagFilters  []string
 	aws                bool
+	registryType       string
+	registryEndpoint   string
+	garbageCollect     bool
+	pageSize           int
+	repositoryPrefix   string
+	concurrency        int
+	policyFile         string
+	where              string
+	keepLabels         string
+	deleteLabels       string
+	planFile           string
+	outputFormat       string
+	htmlReport         string
+	workloadsFile      string
+	noBuiltinWorkloads bool
+	manifestsDirs      []string
+	snapshotFiles      []string
+	namespaces         []string
+	excludeNamespaces  []string
+	labelSelectors     []string
+	snapshotMaxAge     time.Duration
+	snapshotContext    string
+	snapshotFile       string
+	allowPartial       bool
+
+	exitCode int
+)
+
+// Exit codes, so scheduled runs can tell a cleanup from a run that had
+// nothing to do or couldn't see every cluster.
+const (
+	exitDeleted     = 0
+	exitError       = 1
+	exitNothingToDo = 2
+	exitPartial     = 3
 )
 
 var rootCmd = &cobra.Command{
 	Use: "regclean",
+	Long: `Delete images from a registry that no Kubernetes cluster uses.
+
+Exit codes: 0 when images were deleted, 1 on errors, 2 when there was
+nothing to delete or --dry-run was set and 3 when images of a context
+couldn't be fetched.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		run()
+		exitCode = exit(run())
+	},
+}
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Write the digests a cleanup would delete to a plan file",
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = exit(runPlan())
+	},
+}
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Write the images in use in a cluster to a file, for use with --snapshot",
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = exit(exitDeleted, runSnapshot())
+	},
+}
+
+var applyCmd = &cobra.Command{
+	Use:   "apply <plan.json>",
+	Short: "Delete the digests of a plan file whose tags haven't moved since",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitCode = exit(runApply(args[0]))
 	},
 }
 
@@ -47,6 +122,7 @@ func init() {
 		if err := setUpLogs(os.Stdout, v); err != nil {
 			return err
 		}
+		contextsSet = cmd.Flags().Changed("contexts") || os.Getenv("REGCLEAN_CONTEXTS") != ""
 		return nil
 	}
 
@@ -55,13 +131,46 @@ func init() {
 	rootCmd.PersistentFlags().BoolVar(&aws, "aws", false, "Use AWS credentials for registry")
 	rootCmd.PersistentFlags().BoolVar(&logCaller, "log-caller", false, "Print caller in logs")
 	rootCmd.PersistentFlags().IntVar(&minAge, "min-age", 30, "Minimum age of images to delete")
+	rootCmd.PersistentFlags().IntVar(&pageSize, "page-size", 100, "Number of repositories or tags to request per registry page")
+	rootCmd.PersistentFlags().IntVar(&concurrency, "concurrency", 8, "Number of parallel registry metadata requests")
+	rootCmd.PersistentFlags().StringVar(&repositoryPrefix, "repository-prefix", os.Getenv("REGCLEAN_REPOSITORY_PREFIX"), "Only list repositories starting with this prefix")
+	rootCmd.PersistentFlags().IntVar(&keepLast, "keep-last", 0, "Always keep the N most recent images of every repository")
+	rootCmd.PersistentFlags().StringVar(&policyFile, "policy", os.Getenv("REGCLEAN_POLICY"), "(optional) YAML file with per-repository rules, the first matching rule decides")
+	rootCmd.PersistentFlags().StringVar(&where, "where", "", `(optional) CEL expression images must match to be deleted, e.g. repo.startsWith("ci/") && age > duration("72h")`)
+	rootCmd.PersistentFlags().StringVar(&keepLabels, "keep-labels", os.Getenv("REGCLEAN_KEEP_LABELS"), "(optional) Never delete images whose config labels match this selector, e.g. regclean.keep=true")
+	rootCmd.PersistentFlags().StringVar(&deleteLabels, "delete-labels", os.Getenv("REGCLEAN_DELETE_LABELS"), "(optional) Only delete images whose config labels match this selector, e.g. team=a,tier!=prod")
+	rootCmd.PersistentFlags().IntVar(&keepSemverMinors, "keep-semver-minors", 0, "Always keep the latest patch of the last N minor versions of semver tags")
 	rootCmd.PersistentFlags().StringVarP(&v, "verbosity", "v", logrus.DebugLevel.String(), "Log level (debug, info, warn, error, fatal, panic")
 	rootCmd.PersistentFlags().StringVar(&registryURL, "registry-url", os.Getenv("REGCLEAN_REGISTRY_URL"), "URL of the registry you would like to clean")
+	rootCmd.PersistentFlags().StringVar(&registryType, "registry-type", os.Getenv("REGCLEAN_REGISTRY_TYPE"), "Registry backend ("+strings.Join(helpers.RegistryTypes(), ", ")+"), taken from the registry URL scheme when empty")
+	rootCmd.PersistentFlags().StringVar(&registryEndpoint, "registry-endpoint", os.Getenv("REGCLEAN_REGISTRY_ENDPOINT"), "(optional) API endpoint for registry types with a separate API")
+	rootCmd.PersistentFlags().BoolVar(&garbageCollect, "garbage-collect", false, "Trigger a registry garbage collection after deleting, for registry types that support it (harbor)")
 	rootCmd.PersistentFlags().StringVar(&registryUsername, "registry-username", os.Getenv("REGCLEAN_REGISTRY_USERNAME"), "(optional) credentials")
 	rootCmd.PersistentFlags().StringVar(&registryPassword, "registry-password", os.Getenv("REGCLEAN_REGISTRY_PASSWORD"), "(optional) credentials")
-	rootCmd.PersistentFlags().StringSliceVar(&kubeContexts, "contexts", strings.Split(os.Getenv("REGCLEAN_CONTEXTS"), ","), "Kubernetes contexts to check for images")
-	rootCmd.PersistentFlags().StringSliceVar(&excludeNameFilters, "exclude-name-filters", strings.Split(os.Getenv("REGCLEAN_EXCLUDE_NAME_FILTERS"), ","), "Filters to exclude image names")
-	rootCmd.PersistentFlags().StringSliceVar(&includeNameFilters, "include-name-filters", strings.Split(os.Getenv("REGCLEAN_INCLUDE_NAME_FILTERS"), ","), "Filters to include image names")
+	rootCmd.PersistentFlags().StringVar(&registryToken, "registry-token", os.Getenv("REGCLEAN_REGISTRY_TOKEN"), "(optional) API token for registry types that use one (gitlab)")
+	rootCmd.PersistentFlags().StringVar(&workloadsFile, "workload-definitions", os.Getenv("REGCLEAN_WORKLOAD_DEFINITIONS"), "(optional) YAML file with custom resources to read images from, by group, version, resource and JSONPath")
+	rootCmd.PersistentFlags().BoolVar(&noBuiltinWorkloads, "no-builtin-workloads", false, "Don't read Argo Rollouts, Knative and KEDA resources")
+	rootCmd.PersistentFlags().StringArrayVar(&manifestsDirs, "manifests-dir", nil, "(optional) Directory with Kubernetes manifests whose images count as in use, can be repeated")
+	rootCmd.PersistentFlags().StringArrayVar(&snapshotFiles, "snapshot", nil, "(optional) Snapshot file of a cluster's images in use, written by regclean snapshot, can be repeated")
+	rootCmd.PersistentFlags().DurationVar(&snapshotMaxAge, "snapshot-max-age", 24*time.Hour, "Reject snapshots older than this, 0 to accept any age")
+	rootCmd.PersistentFlags().StringSliceVar(&kubeContexts, "contexts", strings.Split(os.Getenv("REGCLEAN_CONTEXTS"), ","), "Kubernetes contexts to check for images, the current context by default, unless --snapshot is given")
+	rootCmd.PersistentFlags().BoolVar(&allowPartial, "allow-partial", false, "Delete even when images of some contexts couldn't be fetched, images only they use will be deleted")
+	rootCmd.PersistentFlags().StringArrayVar(&namespaces, "namespaces", nil, "(optional) Only search these comma separated namespaces for images, as ns1,ns2 or ns1,ns2@context, can be repeated")
+	rootCmd.PersistentFlags().StringArrayVar(&excludeNamespaces, "exclude-namespaces", nil, "(optional) Don't search these comma separated namespaces for images, as ns1,ns2 or ns1,ns2@context, can be repeated")
+	rootCmd.PersistentFlags().StringArrayVar(&labelSelectors, "label-selector", nil, "(optional) Only search objects matching this selector for images, as selector or selector@context, can be repeated")
+	rootCmd.PersistentFlags().StringSliceVar(&excludeNameFilters, "exclude-name-filters", strings.Split(os.Getenv("REGCLEAN_EXCLUDE_NAME_FILTERS"), ","), "Filters to exclude image names, as substring or with a regex: or glob: prefix")
+	rootCmd.PersistentFlags().StringSliceVar(&includeNameFilters, "include-name-filters", strings.Split(os.Getenv("REGCLEAN_INCLUDE_NAME_FILTERS"), ","), "Filters to include image names, as substring or with a regex: or glob: prefix")
+	rootCmd.PersistentFlags().StringArrayVar(&excludeRepoFilters, "exclude-repo", nil, "Repositories to keep, as substring, regex (^...$ or regex:) or glob (team-a/** or glob:)")
+	rootCmd.PersistentFlags().StringArrayVar(&includeRepoFilters, "include-repo", nil, "Only clean matching repositories, as substring, regex or glob")
+	rootCmd.PersistentFlags().StringArrayVar(&excludeTagFilters, "exclude-tag", nil, "Tags to keep, as substring, regex or glob")
+	rootCmd.PersistentFlags().StringArrayVar(&includeTagFilters, "include-tag", nil, "Only clean matching tags, as substring, regex or glob")
+	rootCmd.Flags().StringVar(&outputFormat, "output", "", "(optional) Print every decision of the run as "+strings.Join(ui.Formats, ", "))
+	rootCmd.Flags().StringVar(&htmlReport, "html-report", "", "(optional) Write a self-contained HTML report of the run to this file")
+	planCmd.Flags().StringVarP(&planFile, "output", "o", "plan.json", "File to write the plan to, - for stdout")
+	snapshotCmd.Flags().StringVar(&snapshotContext, "context", "", "Kubernetes context to snapshot, the current context when empty")
+	snapshotCmd.Flags().StringVarP(&snapshotFile, "output", "o", "snapshot.json", "File to write the snapshot to, - for stdout")
+	rootCmd.AddCommand(planCmd, applyCmd, snapshotCmd)
+
 	if home := homedir.HomeDir(); home != "" {
 		rootCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
 	} else {
@@ -72,8 +181,19 @@ func init() {
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		logrus.Error(err)
-		os.Exit(1)
+		os.Exit(exitError)
+	}
+	os.Exit(exitCode)
+}
+
+// exit maps the outcome of a command to its exit code, logging the error
+// that ended it.
+func exit(code int, err error) int {
+	if err != nil {
+		logrus.Error(err)
+		return exitError
 	}
+	return code
 }
 
 func setUpLogs(out io.Writer, level string) error {
@@ -89,83 +209,630 @@ func setUpLogs(out io.Writer, level string) error {
 	return nil
 }
 
-func run() {
+// collect finds the images in the clusters and the registry and decides
+// which digests to delete. The report only lists every image withEntries.
+// Contexts whose images couldn't be fetched are listed in the report, the
+// caller decides whether deleting is safe.
+func collect(withEntries bool) (helpers.Registry, helpers.Plan, ui.Report, error) {
+	// Compile the filters first, so a bad pattern fails before any cluster
+	// or registry is queried.
+	includeRepositories, err := repositoryMatchers(includeNameFilters, includeRepoFilters)
+	if err != nil {
+		return nil, helpers.Plan{}, ui.Report{}, err
+	}
+	excludeRepositories, err := repositoryMatchers(excludeNameFilters, excludeRepoFilters)
+	if err != nil {
+		return nil, helpers.Plan{}, ui.Report{}, err
+	}
+	includeTags, err := helpers.NewMatchers(includeTagFilters)
+	if err != nil {
+		return nil, helpers.Plan{}, ui.Report{}, err
+	}
+	excludeTags, err := helpers.NewMatchers(excludeTagFilters)
+	if err != nil {
+		return nil, helpers.Plan{}, ui.Report{}, err
+	}
+
+	var policy *helpers.Policy
+	if policyFile != "" {
+		if policy, err = helpers.LoadPolicy(policyFile); err != nil {
+			return nil, helpers.Plan{}, ui.Report{}, err
+		}
+	}
+
+	keepSelector, err := labelSelector(keepLabels)
+	if err != nil {
+		return nil, helpers.Plan{}, ui.Report{}, err
+	}
+	deleteSelector, err := labelSelector(deleteLabels)
+	if err != nil {
+		return nil, helpers.Plan{}, ui.Report{}, err
+	}
+
+	var whereExpression *helpers.Expression
+	if where != "" {
+		if whereExpression, err = helpers.NewExpression(where); err != nil {
+			return nil, helpers.Plan{}, ui.Report{}, err
+		}
+	}
+
+	workloads, err := workloadDefinitions()
+	if err != nil {
+		return nil, helpers.Plan{}, ui.Report{}, err
+	}
+	reg, err := newRegistry()
+	if err != nil {
+		return nil, helpers.Plan{}, ui.Report{}, err
+	}
+	if (keepSelector != nil || deleteSelector != nil) && !helpers.HasLabels(reg) {
+		return nil, helpers.Plan{}, ui.Report{}, errors.New("--keep-labels and --delete-labels need the config labels of images, which this registry backend doesn't fetch")
+	}
+
 	clusterImages := []string{}
-	logrus.Infof("Fetching images from %d clusters", len(kubeContexts))
+	contexts := clusterContexts()
+	logrus.Infof("Fetching images from %d clusters", len(contexts))
 	clusterHelper := helpers.NewClusterHelper(kubeconfig)
+	clusterHelper.Workloads = workloads
 
-	for _, kubeContext := range kubeContexts {
-		curImages := clusterHelper.GetImages(kubeContext)
+	failedContexts := []string{}
+	for _, kubeContext := range contexts {
+		scope, err := helpers.NewScope(kubeContext, namespaces, excludeNamespaces, labelSelectors)
+		if err != nil {
+			return nil, helpers.Plan{}, ui.Report{}, err
+		}
+		curImages, err := clusterHelper.GetImages(kubeContext, scope)
+		if err != nil {
+			logrus.Errorf("Failed to fetch images from context %s: %s", contextName(kubeContext), err)
+			failedContexts = append(failedContexts, contextName(kubeContext))
+			continue
+		}
 		logrus.Debugf("Found %d images in context %s", len(curImages), kubeContext)
 		logrus.WithField(
 			"images", curImages,
 		).Tracef("Found %d images in context %s", len(curImages), kubeContext)
 		clusterImages = append(clusterImages, curImages...)
 	}
+	for _, path := range snapshotFiles {
+		snapshot, err := helpers.ReadSnapshot(path, snapshotMaxAge)
+		if err != nil {
+			return nil, helpers.Plan{}, ui.Report{}, err
+		}
+		curImages := helpers.ImageRefs(snapshot.Images)
+		logrus.Debugf("Found %d images in snapshot of context %s from %s", len(curImages), snapshot.Context, snapshot.Created.Format(time.DateTime))
+		logrus.WithField(
+			"images", curImages,
+		).Tracef("Found %d images in snapshot %s", len(curImages), path)
+		clusterImages = append(clusterImages, curImages...)
+	}
+	for _, dir := range manifestsDirs {
+		curImages, err := helpers.NewManifestHelper(dir).GetImages()
+		if err != nil {
+			return nil, helpers.Plan{}, ui.Report{}, err
+		}
+		logrus.Debugf("Found %d images in manifests in %s", len(curImages), dir)
+		logrus.WithField(
+			"images", curImages,
+		).Tracef("Found %d images in manifests in %s", len(curImages), dir)
+		clusterImages = append(clusterImages, curImages...)
+	}
 	clusterImages = utils.Unique(clusterImages)
-	logrus.Infof("Collected %d unique images in %d contexts", len(clusterImages), len(kubeContexts))
+	logrus.Infof("Collected %d unique images in %d contexts, %d snapshots and %d manifest directories", len(clusterImages), len(contexts)-len(failedContexts), len(snapshotFiles), len(manifestsDirs))
+	if len(failedContexts) > 0 {
+		logrus.Warnf("Failed to fetch images from %d of %d contexts: %s", len(failedContexts), len(contexts), strings.Join(failedContexts, ", "))
+	}
+
+	clusterDigests := map[string]bool{}
+	for _, image := range clusterImages {
+		if _, digest, found := strings.Cut(image, "@"); found {
+			clusterDigests[digest] = true
+		}
+	}
 
 	logrus.Info("Fetching images from registry")
+
+	filterHelper := helpers.NewFilterHelper(reg)
+	filterHelper.MinAge = minAge
+	filterHelper.ExcludeRepositories = excludeRepositories
+	filterHelper.IncludeRepositories = includeRepositories
+	filterHelper.ExcludeTags = excludeTags
+	filterHelper.IncludeTags = includeTags
+	filterHelper.KeepLast = keepLast
+	filterHelper.KeepSemverMinors = keepSemverMinors
+	filterHelper.Policy = policy
+	filterHelper.Where = whereExpression
+	filterHelper.KeepLabels = keepSelector
+	filterHelper.DeleteLabels = deleteSelector
+	filterHelper.MarkInUse(clusterImages)
+	filterHelper.LogFilters()
+
+	clusterImageSet := map[string]bool{}
+	for _, image := range clusterImages {
+		clusterImageSet[image] = true
+	}
+
+	plan := helpers.Plan{
+		Registry: reg.Prefix(),
+		Created:  time.Now().UTC(),
+	}
+	report := ui.Report{
+		Registry: reg.Prefix(),
+		Created:  time.Now().UTC(),
+	}
+	space := helpers.NewSpaceCounter()
+	imageCount, deleteCount, deleteDigests := 0, 0, 0
+	keptLastCount, keptSemverCount, sharedCount := 0, 0, 0
+
+	// Repositories are decided on one at a time as the registry is walked,
+	// so the catalog is never held in memory.
+	err = helpers.WalkRepositories(reg, concurrency, func(repo string, images []string) error {
+		imageCount += len(images)
+		logrus.WithField(
+			"images", images,
+		).Tracef("Found %d images in %s", len(images), repo)
+
+		toDelete := []string{}
+		inUse := map[string]bool{}
+		for _, image := range images {
+			if clusterImageSet[image] {
+				inUse[image] = true
+				continue
+			}
+			if meta, err := reg.ImageMeta(image); err == nil {
+				if dgst, ok := meta.RunningDigest(clusterDigests); ok {
+					logrus.Tracef("Image %s is in use by digest %s", image, dgst)
+					inUse[image] = true
+					continue
+				}
+			}
+			if !filterHelper.FilterImage(image) {
+				continue
+			}
+			toDelete = append(toDelete, image)
+		}
+
+		toDelete, keptLast := filterHelper.KeepLastImages(images, toDelete)
+		keptLastCount += len(keptLast)
+		toDelete, keptSemver := filterHelper.KeepSemverImages(images, toDelete)
+		keptSemverCount += len(keptSemver)
+
+		deleteSet := map[string]bool{}
+		for _, image := range toDelete {
+			deleteSet[image] = true
+		}
+
+		// Deleting a manifest removes every tag pointing at it, so a digest
+		// is only deleted when none of its tags are in use or kept by a
+		// filter.
+		toDeleteGroups := []helpers.DigestGroup{}
+		toKeepGroups := []helpers.DigestGroup{}
+		metas := map[string]*helpers.ImageMeta{}
+		for _, group := range helpers.GroupByDigest(reg, images) {
+			deletable := 0
+			for _, image := range group.Images {
+				if deleteSet[image] {
+					deletable++
+				}
+			}
+			if deletable == 0 {
+				toKeepGroups = append(toKeepGroups, group)
+				continue
+			}
+			if deletable < len(group.Images) {
+				logrus.WithField(
+					"tags", group.Tags,
+				).Tracef("Digest %s@%s is shared with tags we keep, skipping", group.Repository, group.Digest)
+				sharedCount += deletable
+				toKeepGroups = append(toKeepGroups, group)
+				continue
+			}
+			meta, err := reg.ImageMeta(group.Images[0])
+			if err != nil {
+				logrus.WithField(
+					"tags", group.Tags,
+				).Warnf("Failed to get metadata of %s@%s, keeping it: %s", group.Repository, group.Digest, err)
+				toKeepGroups = append(toKeepGroups, group)
+				continue
+			}
+			metas[group.Digest] = meta
+			toDeleteGroups = append(toDeleteGroups, group)
+		}
+		toDeleteGroups, toKeepGroups = helpers.PruneSharedChildren(toDeleteGroups, toKeepGroups)
+		filterHelper.CountDeleted(toDeleteGroups)
+
+		for _, group := range toDeleteGroups {
+			meta := metas[group.Digest]
+			deleteCount += len(group.Tags)
+			deleteDigests++
+
+			decision, _ := filterHelper.Decision(group.Images[0])
+			plan.Entries = append(plan.Entries, helpers.NewPlanEntry(
+				group, meta, filterHelper.DeleteReason(group.Images[0]), decision.Rule,
+			))
+
+			logFields := logrus.Fields{
+				"created": meta.Created.Format(time.DateTime),
+				"size":    humanize.Bytes(meta.TotalSize),
+				"tags":    group.Tags,
+			}
+			if decision.Rule != "" {
+				logFields["rule"] = decision.Rule
+			}
+			logrus.WithFields(logFields).Debugf("Deleting %s@%s", group.Repository, group.Digest)
+		}
+		space.Add(reg, toDeleteGroups, toKeepGroups)
+
+		if withEntries {
+			report.Entries = append(report.Entries, reportEntries(reg, images, toDeleteGroups, inUse, deleteSet, filterHelper)...)
+		}
+		filterHelper.Forget(images)
+		return nil
+	})
+	if err != nil {
+		return nil, helpers.Plan{}, ui.Report{}, err
+	}
+	logrus.Infof("Collected %d images from registry", imageCount)
+	filterHelper.LogStats()
+
+	// Layers shared with kept images stay, so only part of the logical size
+	// is freed by the registry garbage collection.
+	total, spaceByRepo := space.Space()
+	repos := []string{}
+	for repo := range spaceByRepo {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		logrus.WithFields(logrus.Fields{
+			"logical":     humanize.Bytes(spaceByRepo[repo].Logical),
+			"reclaimable": ui.Space(spaceByRepo[repo]).ReclaimableBytes(),
+		}).Debugf("Space freed in %s", repo)
+	}
+
+	logrus.Infof(
+		"Found %d digests with %d tags to delete (%s logical, %s reclaimable) and %d tags to keep (%d kept as newest, %d by semver, %d sharing a digest with a kept tag)",
+		deleteDigests, deleteCount, humanize.Bytes(total.Logical), ui.Space(total).ReclaimableBytes(), imageCount-deleteCount, keptLastCount, keptSemverCount, sharedCount,
+	)
+	if total.Approximate {
+		logrus.Warn("The registry doesn't report the layers of every image, layers they share with kept images count as reclaimable")
+	}
+
+	report.Stats = filterHelper.Stats()
+	report.Space = ui.Space(total)
+	report.RepositorySpace = map[string]ui.Space{}
+	for repo, usage := range spaceByRepo {
+		report.RepositorySpace[repo] = ui.Space(usage)
+	}
+	if len(failedContexts) > 0 {
+		report.FailedContexts = failedContexts
+	}
+	return reg, plan, report, nil
+}
+
+// decisions is the part of the filter helper the report is made from.
+type decisions interface {
+	Decision(image string) (helpers.Decision, bool)
+	DeleteReason(image string) string
+}
+
+// reportEntries records the decision for every image of a repository.
+func reportEntries(reg helpers.Registry, images []string, toDeleteGroups []helpers.DigestGroup, inUse, deletable map[string]bool, filterHelper decisions) []ui.ReportEntry {
+	deleted := map[string]bool{}
+	for _, group := range toDeleteGroups {
+		for _, image := range group.Images {
+			deleted[image] = true
+		}
+	}
+
+	entries := []ui.ReportEntry{}
+	for _, image := range images {
+		repo, tag, _ := strings.Cut(strings.TrimPrefix(image, reg.Prefix()+"/"), ":")
+		entry := ui.ReportEntry{
+			Image:      image,
+			Repository: repo,
+			Tag:        tag,
+		}
+		meta, err := reg.ImageMeta(image)
+		if err == nil {
+			entry.Digest = meta.Digest
+			entry.Size = meta.TotalSize
+			entry.Created = meta.Created
+		}
+		decision, _ := filterHelper.Decision(image)
+		entry.Rule = decision.Rule
+
+		switch {
+		case inUse[image]:
+			entry.Status = ui.StatusInUse
+		case err != nil:
+			entry.Status = ui.StatusError
+			entry.Error = err.Error()
+		case decision.Reason == "error":
+			entry.Status = ui.StatusError
+			entry.Error = "failed to evaluate filters"
+		case deleted[image]:
+			entry.Status = ui.StatusDelete
+			entry.Reason = filterHelper.DeleteReason(image)
+		case deletable[image]:
+			entry.Status = ui.StatusKept
+			entry.Filter = "shared_digest"
+		default:
+			entry.Status = ui.StatusKept
+			entry.Filter = decision.Reason
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func workloadDefinitions() ([]helpers.WorkloadDefinition, error) {
+	workloads := []helpers.WorkloadDefinition{}
+	if !noBuiltinWorkloads {
+		workloads = append(workloads, helpers.BuiltinWorkloads...)
+	}
+	if workloadsFile != "" {
+		custom, err := helpers.LoadWorkloadDefinitions(workloadsFile)
+		if err != nil {
+			return nil, err
+		}
+		workloads = append(workloads, custom...)
+	}
+	return workloads, nil
+}
+
+func newRegistry() (helpers.Registry, error) {
 	if aws {
-		registryUsername, registryPassword = auth.GetAWSCredentials()
+		var err error
+		if registryUsername, registryPassword, err = auth.GetAWSCredentials(); err != nil {
+			return nil, err
+		}
 	}
 
-	regHelper := helpers.NewRegHelper(registryURL, registryUsername, registryPassword, dryRun)
-	registryImages := regHelper.GetImages()
-	logrus.Infof("Collected %d images from registry", len(registryImages))
-	logrus.WithField(
-		"images", registryImages,
-	).Tracef("Found %d images in registry", len(registryImages))
+	return helpers.NewRegistry(registryType, helpers.RegistryOptions{
+		URL:              registryURL,
+		Username:         registryUsername,
+		Password:         registryPassword,
+		Token:            registryToken,
+		Endpoint:         registryEndpoint,
+		DryRun:           dryRun,
+		PageSize:         pageSize,
+		RepositoryPrefix: repositoryPrefix,
+		GarbageCollect:   garbageCollect,
+	})
+}
 
-	toDelete := []string{}
-	toKeep := []string{}
-	for _, registryImage := range registryImages {
-		if !slices.Contains(clusterImages, registryImage) {
-			toDelete = append(toDelete, registryImage)
-		} else {
-			toKeep = append(toKeep, registryImage)
+func run() (int, error) {
+	if outputFormat != "" {
+		if !slices.Contains(ui.Formats, outputFormat) {
+			return exitError, fmt.Errorf("unknown output format %q, expected one of %s", outputFormat, strings.Join(ui.Formats, ", "))
+		}
+		if outputFormat != "table" {
+			// Keep the logs out of the report.
+			logrus.SetOutput(os.Stderr)
 		}
 	}
 
-	filterHelper := helpers.NewFilterHelper(*regHelper)
-	filterHelper.MinAge = minAge
-	filterHelper.ExcludeNameFilters = utils.DeleteEmpty(excludeNameFilters)
-	filterHelper.IncludeNameFilters = utils.DeleteEmpty(includeNameFilters)
-	toDelete, filterCount := filterHelper.FilterImages(toDelete)
+	reg, plan, report, err := collect(outputFormat != "" || htmlReport != "")
+	if err != nil {
+		return exitError, err
+	}
+	if outputFormat != "" {
+		if err := report.Write(os.Stdout, outputFormat); err != nil {
+			return exitError, err
+		}
+	}
+	if htmlReport != "" {
+		if err := writeHTMLReport(htmlReport, report); err != nil {
+			return exitError, err
+		}
+		logrus.Infof("Wrote HTML report to %s", htmlReport)
+	}
+	return deleteCollected(reg, plan, report)
+}
 
-	total := uint64(0)
-	for _, image := range toDelete {
-		size, _ := regHelper.GetImageSize(image)
-		total += size
+// deleteCollected deletes the plan collected for report, unless contexts
+// failed and partial runs aren't allowed.
+func deleteCollected(reg helpers.Registry, plan helpers.Plan, report ui.Report) (int, error) {
+	if !partialAllowed(report) {
+		return exitPartial, nil
 	}
+	code, err := deletePlan(reg, plan)
+	if err != nil || len(report.FailedContexts) == 0 {
+		return code, err
+	}
+	return exitPartial, nil
+}
 
-	for _, image := range toDelete {
-		img := strings.TrimPrefix(image, regHelper.RegPrefix+"/")
-		created, _ := regHelper.GetImageDate(image)
-		size, _ := regHelper.GetImageSize(image)
+func runPlan() (int, error) {
+	if planFile == "-" {
+		// Keep the logs out of the plan.
+		logrus.SetOutput(os.Stderr)
+	}
+	_, plan, report, err := collect(false)
+	if err != nil {
+		return exitError, err
+	}
+	if !partialAllowed(report) {
+		return exitPartial, nil
+	}
+	if err := helpers.WritePlan(planFile, plan); err != nil {
+		return exitError, err
+	}
+	logrus.Infof("Wrote %d digests to delete to %s", len(plan.Entries), planFile)
+	switch {
+	case len(report.FailedContexts) > 0:
+		return exitPartial, nil
+	case len(plan.Entries) == 0:
+		return exitNothingToDo, nil
+	}
+	return exitDeleted, nil
+}
 
-		logrus.WithFields(logrus.Fields{
-			"created": created.Format(time.DateTime),
-			"size":    humanize.Bytes(size),
-		}).Debugf("Deleting %s", img)
+func runSnapshot() error {
+	if snapshotFile == "-" {
+		// Keep the logs out of the snapshot.
+		logrus.SetOutput(os.Stderr)
 	}
 
-	logrus.Infof("Found %d images to delete (%s) and %d to keep", len(toDelete), humanize.Bytes(total), len(toKeep)+filterCount)
+	workloads, err := workloadDefinitions()
+	if err != nil {
+		return err
+	}
+	scope, err := helpers.NewScope(snapshotContext, namespaces, excludeNamespaces, labelSelectors)
+	if err != nil {
+		return err
+	}
+	clusterHelper := helpers.NewClusterHelper(kubeconfig)
+	clusterHelper.Workloads = workloads
+	images, err := clusterHelper.GetClusterImages(snapshotContext, scope)
+	if err != nil {
+		return fmt.Errorf("failed to fetch images from context %s: %w", contextName(snapshotContext), err)
+	}
+	snapshot := helpers.Snapshot{
+		Context: snapshotContext,
+		Created: time.Now().UTC(),
+		Images:  images,
+	}
+	if err := helpers.WriteSnapshot(snapshotFile, snapshot); err != nil {
+		return err
+	}
+	logrus.Infof("Wrote %d images of context %s to %s", len(snapshot.Images), contextName(snapshotContext), snapshotFile)
+	return nil
+}
+
+func runApply(path string) (int, error) {
+	plan, err := helpers.ReadPlan(path)
+	if err != nil {
+		return exitError, err
+	}
+	reg, err := newRegistry()
+	if err != nil {
+		return exitError, err
+	}
+	if plan.Registry != reg.Prefix() {
+		return exitError, fmt.Errorf("plan %s was made for registry %s, not %s", path, plan.Registry, reg.Prefix())
+	}
+	logrus.Infof("Applying plan %s from %s with %d digests", path, plan.Created.Format(time.DateTime), len(plan.Entries))
 
-	if len(toDelete) == 0 {
+	// Tags may have been pushed again since the plan was made, deleting
+	// their digest now would delete something nobody reviewed.
+	tags, err := helpers.ResolvePlanTags(reg, *plan)
+	if err != nil {
+		return exitError, err
+	}
+	// A skipped index keeps the platform manifests it shares with other
+	// entries, which are checked again until no more are skipped.
+	for skipped := true; skipped; {
+		remaining := []helpers.PlanEntry{}
+		for _, entry := range plan.Entries {
+			if err := entry.Verify(tags); err != nil {
+				logrus.Warnf("Skipping %s@%s: %s", entry.Repository, entry.Digest, err)
+				tags.Skip(entry)
+				continue
+			}
+			remaining = append(remaining, entry)
+		}
+		skipped = len(remaining) < len(plan.Entries)
+		plan.Entries = remaining
+	}
+	return deletePlan(reg, *plan)
+}
+
+func writeHTMLReport(path string, report ui.Report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := report.WriteHTML(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// partialAllowed reports whether the plan of report may be acted on. Images
+// of failed contexts look unused, so deleting is refused unless the user
+// accepts that with --allow-partial.
+func partialAllowed(report ui.Report) bool {
+	if len(report.FailedContexts) == 0 {
+		return true
+	}
+	if !allowPartial {
+		logrus.Errorf("Not deleting anything, images of contexts %s couldn't be fetched, use --allow-partial to delete anyway", strings.Join(report.FailedContexts, ", "))
+		return false
+	}
+	logrus.Warnf("Deleting although images of contexts %s couldn't be fetched", strings.Join(report.FailedContexts, ", "))
+	return true
+}
+
+// confirm asks the user a yes or no question, tests answer it themselves.
+var confirm = ui.YesNo
+
+// deletePlan asks for confirmation and deletes the digests of plan. It
+// returns the exit code for the outcome, dry runs delete nothing.
+func deletePlan(reg helpers.Registry, plan helpers.Plan) (int, error) {
+	if len(plan.Entries) == 0 {
 		logrus.Info("Nothing to delete")
-		return
+		return exitNothingToDo, nil
 	}
 
-	if yolo && !ui.YesNo("We will delete all without asking, are you sure?") {
-		logrus.Fatal("Back to safety")
+	if yolo && !confirm("We will delete all without asking, are you sure?") {
+		return exitError, errors.New("back to safety")
 	}
 
-	for _, image := range toDelete {
-		if yolo || ui.YesNo(fmt.Sprintf("Delete %s?", image)) {
-			if err := regHelper.DeleteImage(image); err != nil {
-                logrus.WithField("image", image).Errorf("Failed to delete image: %s", err)
-			}
+	confirmed := []helpers.DigestGroup{}
+	for _, entry := range plan.Entries {
+		if yolo || confirm(fmt.Sprintf("Delete %s@%s (%s)?", entry.Repository, entry.Digest, strings.Join(entry.Tags, ", "))) {
+			confirmed = append(confirmed, entry.Group(reg))
 		}
 	}
+	if len(confirmed) == 0 {
+		logrus.Info("Nothing to delete")
+		return exitNothingToDo, nil
+	}
+	if err := reg.DeleteDigests(confirmed); err != nil {
+		return exitError, fmt.Errorf("failed to delete images: %w", err)
+	}
+	if dryRun {
+		return exitNothingToDo, nil
+	}
+	return exitDeleted, nil
+}
+
+// clusterContexts returns the contexts to fetch images from. Snapshots
+// replace the implicit current context, clusters are only checked alongside
+// them when --contexts or REGCLEAN_CONTEXTS names them.
+func clusterContexts() []string {
+	if len(snapshotFiles) > 0 && !contextsSet {
+		return []string{}
+	}
+	return kubeContexts
+}
+
+// contextName names kubeContext in logs, where the current context is empty.
+func contextName(kubeContext string) string {
+	if kubeContext == "" {
+		return "(current)"
+	}
+	return kubeContext
+}
+
+// repositoryMatchers compiles the name filters, matched as substrings, and
+// the repository filters of one side.
+func repositoryMatchers(nameFilters, repoFilters []string) ([]helpers.Matcher, error) {
+	names, err := helpers.NewSubstringMatchers(nameFilters)
+	if err != nil {
+		return nil, err
+	}
+	repos, err := helpers.NewMatchers(repoFilters)
+	if err != nil {
+		return nil, err
+	}
+	return append(names, repos...), nil
+}
+
+func labelSelector(selector string) (*helpers.LabelSelector, error) {
+	if selector == "" {
+		return nil, nil
+	}
+	return helpers.ParseLabelSelector(selector)
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stenic/regclean/pkg/helpers"
+	"github.com/stenic/regclean/pkg/ui"
+)
+
+// fakeRegistry records the digests it's asked to delete.
+type fakeRegistry struct {
+	deleted []helpers.DigestGroup
+	err     error
+}
+
+func (r *fakeRegistry) Prefix() string {
+	return "registry.test"
+}
+
+func (r *fakeRegistry) WalkImages(fn func(image string)) error {
+	return nil
+}
+
+func (r *fakeRegistry) ImageMeta(image string) (*helpers.ImageMeta, error) {
+	return nil, errors.New("no metadata")
+}
+
+func (r *fakeRegistry) ResolveDigest(image string) (string, error) {
+	return "", errors.New("no digest")
+}
+
+func (r *fakeRegistry) DeleteDigests(groups []helpers.DigestGroup) error {
+	r.deleted = append(r.deleted, groups...)
+	return r.err
+}
+
+// withFlags sets the flags deleting depends on for the test and answers
+// every confirmation with answer.
+func withFlags(t *testing.T, dry, all, partial, answer bool) {
+	oldDryRun, oldYolo, oldAllowPartial, oldConfirm := dryRun, yolo, allowPartial, confirm
+	t.Cleanup(func() {
+		dryRun, yolo, allowPartial, confirm = oldDryRun, oldYolo, oldAllowPartial, oldConfirm
+	})
+	dryRun, yolo, allowPartial = dry, all, partial
+	confirm = func(question string) bool { return answer }
+}
+
+func testPlan() helpers.Plan {
+	return helpers.Plan{
+		Registry: "registry.test",
+		Entries:  []helpers.PlanEntry{{Repository: "app", Digest: "sha256:a1", Tags: []string{"1.0"}}},
+	}
+}
+
+func TestDeletePlan(t *testing.T) {
+	tests := []struct {
+		name        string
+		plan        helpers.Plan
+		dryRun      bool
+		yolo        bool
+		answer      bool
+		deleteErr   error
+		want        int
+		wantDeleted int
+	}{
+		{name: "nothing to delete", plan: helpers.Plan{}, answer: true, want: exitNothingToDo},
+		{name: "deletes", plan: testPlan(), answer: true, want: exitDeleted, wantDeleted: 1},
+		{name: "dry run", plan: testPlan(), dryRun: true, answer: true, want: exitNothingToDo, wantDeleted: 1},
+		{name: "declined", plan: testPlan(), want: exitNothingToDo},
+		{name: "yolo", plan: testPlan(), yolo: true, answer: true, want: exitDeleted, wantDeleted: 1},
+		{name: "yolo declined", plan: testPlan(), yolo: true, want: exitError},
+		{name: "failed deletes", plan: testPlan(), answer: true, deleteErr: errors.New("denied"), want: exitError, wantDeleted: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFlags(t, tt.dryRun, tt.yolo, false, tt.answer)
+			reg := &fakeRegistry{err: tt.deleteErr}
+
+			if got := exit(deletePlan(reg, tt.plan)); got != tt.want {
+				t.Errorf("exit code = %d, want %d", got, tt.want)
+			}
+			if len(reg.deleted) != tt.wantDeleted {
+				t.Errorf("deleted %d digests, want %d", len(reg.deleted), tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestDeleteCollected(t *testing.T) {
+	tests := []struct {
+		name           string
+		failedContexts []string
+		allowPartial   bool
+		deleteErr      error
+		want           int
+		wantDeleted    int
+	}{
+		{name: "all contexts", want: exitDeleted, wantDeleted: 1},
+		{name: "failed contexts", failedContexts: []string{"prod"}, want: exitPartial},
+		{name: "failed contexts allowed", failedContexts: []string{"prod"}, allowPartial: true, want: exitPartial, wantDeleted: 1},
+		{name: "failed deletes win", failedContexts: []string{"prod"}, allowPartial: true, deleteErr: errors.New("denied"), want: exitError, wantDeleted: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFlags(t, false, true, tt.allowPartial, true)
+			reg := &fakeRegistry{err: tt.deleteErr}
+			report := ui.Report{FailedContexts: tt.failedContexts}
+
+			if got := exit(deleteCollected(reg, testPlan(), report)); got != tt.want {
+				t.Errorf("exit code = %d, want %d", got, tt.want)
+			}
+			if len(reg.deleted) != tt.wantDeleted {
+				t.Errorf("deleted %d digests, want %d", len(reg.deleted), tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	oldOutputFormat := outputFormat
+	t.Cleanup(func() { outputFormat = oldOutputFormat })
+
+	outputFormat = "xml"
+	if got := exit(run()); got != exitError {
+		t.Errorf("exit code of an unknown output format = %d, want %d", got, exitError)
+	}
+	if got := exit(runApply(filepath.Join(t.TempDir(), "missing.json"))); got != exitError {
+		t.Errorf("exit code of a missing plan = %d, want %d", got, exitError)
+	}
+}
+
+func TestCollectRejectsExpressions(t *testing.T) {
+	created := 0
+	helpers.RegisterRegistryType("counting", func(opts helpers.RegistryOptions) (helpers.Registry, error) {
+		created++
+		return &fakeRegistry{}, nil
+	})
+	oldRegistryURL, oldWhere := registryURL, where
+	t.Cleanup(func() { registryURL, where = oldRegistryURL, oldWhere })
+	registryURL = "counting://registry.test"
+
+	for _, expression := range []string{`repo.startsWith("ci/") &&`, `size * 2`} {
+		where = expression
+		if _, _, _, err := collect(false); err == nil {
+			t.Errorf("collect() with --where %q, want an error", expression)
+		}
+	}
+	if created > 0 {
+		t.Errorf("created %d registries before rejecting the expressions", created)
+	}
+}
+
+func TestClusterContexts(t *testing.T) {
+	oldContexts, oldContextsSet, oldSnapshotFiles := kubeContexts, contextsSet, snapshotFiles
+	t.Cleanup(func() { kubeContexts, contextsSet, snapshotFiles = oldContexts, oldContextsSet, oldSnapshotFiles })
+
+	tests := []struct {
+		name      string
+		contexts  []string
+		set       bool
+		snapshots []string
+		want      []string
+	}{
+		{name: "current context", contexts: []string{""}, want: []string{""}},
+		{name: "snapshot only", contexts: []string{""}, snapshots: []string{"prod.json"}, want: []string{}},
+		{name: "snapshot and contexts", contexts: []string{"staging"}, set: true, snapshots: []string{"prod.json"}, want: []string{"staging"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kubeContexts, contextsSet, snapshotFiles = tt.contexts, tt.set, tt.snapshots
+			if got := clusterContexts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("clusterContexts() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,31 +3,38 @@ package auth
 import (
 	"context"
 	"encoding/base64"
-	"log"
+	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ecr"
 )
 
-func GetAWSCredentials() (string, string) {
+func GetAWSCredentials() (string, string, error) {
 	cfg, err := config.LoadDefaultConfig(context.TODO())
 	if err != nil {
-		log.Fatal(err)
+		return "", "", fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	svc := ecr.NewFromConfig(cfg)
 	token, err := svc.GetAuthorizationToken(context.TODO(), &ecr.GetAuthorizationTokenInput{})
 	if err != nil {
-		log.Fatal(err)
+		return "", "", fmt.Errorf("failed to get an ECR authorization token: %w", err)
+	}
+	if len(token.AuthorizationData) == 0 || token.AuthorizationData[0].AuthorizationToken == nil {
+		return "", "", errors.New("ECR returned no authorization token")
 	}
 
 	authData := token.AuthorizationData[0].AuthorizationToken
 	data, err := base64.StdEncoding.DecodeString(*authData)
 	if err != nil {
-		log.Fatal(err)
+		return "", "", fmt.Errorf("failed to decode the ECR authorization token: %w", err)
 	}
 
 	parts := strings.SplitN(string(data), ":", 2)
-	return parts[0], parts[1]
+	if len(parts) != 2 {
+		return "", "", errors.New("ECR authorization token is not user:password")
+	}
+	return parts[0], parts[1], nil
 }
@@ -6,11 +6,15 @@ import (
 	"github.com/eko/gocache/lib/v4/cache"
 )
 
-func NewCache[T any]() *cache.Cache[T] {
+func NewCache[T any]() (*cache.Cache[T], error) {
 	cacheDir := "./.cache"
 	os.Mkdir(cacheDir, 0775)
 
-	return cache.New[T](NewSQLLiteStore[T]())
+	store, err := NewSQLLiteStore[T]()
+	if err != nil {
+		return nil, err
+	}
+	return cache.New[T](store), nil
 
 	// return cache.New[T](DiskStore[T]{
 	// 	baseDir: cacheDir,
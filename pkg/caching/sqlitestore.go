@@ -30,7 +30,7 @@ type dbRec struct {
 	Data []byte `db:"data"`
 }
 
-func NewSQLLiteStore[T any]() store.StoreInterface {
+func NewSQLLiteStore[T any]() (store.StoreInterface, error) {
 	cacheDir := "./.cache"
 	os.Mkdir(cacheDir, 0775)
 
@@ -44,20 +44,27 @@ func NewSQLLiteStore[T any]() store.StoreInterface {
 
 	db, err := sqlx.Connect("sqlite3", dbFile)
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, fmt.Errorf("failed to open cache %s: %w", dbFile, err)
 	}
 
+	// Metadata is fetched concurrently, serialize access so writers don't
+	// run into a locked database.
+	db.SetMaxOpenConns(1)
+
 	if needsInit {
 		logrus.Debug("Creating schema")
-		db.MustExec(`create table cache (
+		if _, err := db.Exec(`create table cache (
 			key text not null primary key,
 			data blob
-		)`)
+		)`); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create cache %s: %w", dbFile, err)
+		}
 	}
 
 	return &SQLLiteStore[T]{
 		db: db,
-	}
+	}, nil
 }
 
 func (store SQLLiteStore[T]) Get(ctx context.Context, key any) (any, error) {
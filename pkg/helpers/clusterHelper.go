@@ -3,47 +3,162 @@ package helpers
 import (
 	"context"
 	"encoding/json"
-	"github.com/stenic/regclean/pkg/utils"
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/stenic/regclean/pkg/utils"
 	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 type clusterHelper struct {
 	kubeconfig string
+
+	// Workloads are the custom resources read through the dynamic client.
+	Workloads []WorkloadDefinition
 }
 
 func NewClusterHelper(kubeconfig string) *clusterHelper {
 	return &clusterHelper{
 		kubeconfig: kubeconfig,
+		Workloads:  BuiltinWorkloads,
 	}
 }
 
-func (h clusterHelper) GetImages(kubeContext string) []string {
-	clientset := h.getClientsetForContext(kubeContext)
+// ClusterImage is an image found in a cluster, with the digest the runtime
+// resolved it to when known, the workload it belongs to and when it was
+// seen there.
+type ClusterImage struct {
+	Image     string    `json:"image"`
+	Digest    string    `json:"digest,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	OwnerKind string    `json:"ownerKind,omitempty"`
+	OwnerName string    `json:"ownerName,omitempty"`
+	Seen      time.Time `json:"seen"`
+}
 
-	images := []string{}
-	logrus.Trace("Fetching images from pods")
-	images = append(images, h.getPodImages(clientset)...)
+// GetImages returns the references of every image in use in scope of
+// kubeContext, both by tag and by digest.
+func (h clusterHelper) GetImages(kubeContext string, scope Scope) ([]string, error) {
+	images, err := h.GetClusterImages(kubeContext, scope)
+	if err != nil {
+		return nil, err
+	}
+	return ImageRefs(images), nil
+}
+
+// GetClusterImages returns every image in use in scope of kubeContext. Any
+// error fails the whole context, as a partial list of images would let
+// images in use be deleted.
+func (h clusterHelper) GetClusterImages(kubeContext string, scope Scope) ([]ClusterImage, error) {
+	config, err := h.getConfigForContext(kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	lister := newScopedLister(clientset, scope)
+
+	sources := []struct {
+		name string
+		get  func(lister *scopedLister) ([]ClusterImage, error)
+	}{
+		{"pods", h.getPodImages},
+		{"statefulsets / daemonsets", h.getControllerRevisionImages},
+		{"replicasets", h.getReplicaSetImages},
+		// Workloads scaled to zero or between runs have no pods or
+		// replicasets with their current template, so read the templates
+		// themselves.
+		{"deployments", h.getDeploymentImages},
+		{"statefulsets", h.getStatefulSetImages},
+		{"daemonsets", h.getDaemonSetImages},
+		{"jobs", h.getJobImages},
+		{"cronjobs", h.getCronJobImages},
+	}
+
+	images := []ClusterImage{}
+	add := func(found []ClusterImage) {
+		seen := time.Now().UTC()
+		for _, image := range found {
+			image.Seen = seen
+			images = append(images, image)
+		}
+	}
+	for _, source := range sources {
+		logrus.Tracef("Fetching images from %s", source.name)
+		found, err := source.get(lister)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch images from %s: %w", source.name, err)
+		}
+		add(found)
+	}
+
+	if len(h.Workloads) > 0 {
+		dynamicClient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		for _, workload := range h.Workloads {
+			logrus.Tracef("Fetching images from %s", workload.gvr())
+			found, err := workload.images(dynamicClient, lister)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch images from %s: %w", workload.gvr(), err)
+			}
+			add(found)
+		}
+	}
 
-	logrus.Trace("Fetching images from statefulsets / daemonsets")
-	images = append(images, h.getControllerRevisionImages(clientset)...)
+	// Cluster-wide lists include the excluded namespaces.
+	scoped := []ClusterImage{}
+	for _, image := range images {
+		if !scope.excludes(image.Namespace) {
+			scoped = append(scoped, image)
+		}
+	}
+	return scoped, nil
+}
 
-	logrus.Trace("Fetching images from replicasets")
-	images = append(images, h.getReplicaSetImages(clientset)...)
+// ImageRefs returns the references of images, split into their tag and
+// digest forms.
+func ImageRefs(images []ClusterImage) []string {
+	refs := []string{}
+	for _, image := range images {
+		refs = append(refs, image.Image)
+		if image.Digest != "" {
+			repo, _, _ := splitReference(image.Image)
+			refs = append(refs, repo+"@"+image.Digest)
+		}
+	}
 
 	logrus.Trace("Filtering and cleaning images")
-	images = utils.Unique(images)
-	images = h.cleanImageNames(images)
+	return cleanImageNames(utils.Unique(refs))
+}
 
-	return images
+// splitReference splits an image reference into its repository, tag and
+// digest, dropping any URL scheme. The tag and digest are empty when the
+// reference has none.
+func splitReference(image string) (string, string, string) {
+	if i := strings.Index(image, "://"); i >= 0 {
+		image = image[i+3:]
+	}
+	image, digest, _ := strings.Cut(image, "@")
+	tag := ""
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, tag = image[:i], image[i+1:]
+	}
+	return image, tag, digest
 }
 
-func (h clusterHelper) getClientsetForContext(context string) *kubernetes.Clientset {
+func (h clusterHelper) getConfigForContext(context string) (*rest.Config, error) {
 	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
 		&clientcmd.ClientConfigLoadingRules{ExplicitPath: h.kubeconfig},
 		&clientcmd.ConfigOverrides{
@@ -51,71 +166,221 @@ func (h clusterHelper) getClientsetForContext(context string) *kubernetes.Client
 		}).ClientConfig()
 
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, err
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		logrus.Fatal(err)
+	return config, nil
+}
+
+// workloadImages records images as used by the object with kind and meta,
+// or by its controller when it has one.
+func workloadImages(kind string, meta v1.ObjectMeta, images []string) []ClusterImage {
+	if owner := v1.GetControllerOf(&meta); owner != nil {
+		kind = owner.Kind
+		meta.Name = owner.Name
+	}
+	records := []ClusterImage{}
+	for _, image := range images {
+		records = append(records, ClusterImage{
+			Image:     image,
+			Namespace: meta.Namespace,
+			OwnerKind: kind,
+			OwnerName: meta.Name,
+		})
 	}
+	return records
+}
 
-	return clientset
+func (h clusterHelper) getPodImages(lister *scopedLister) ([]ClusterImage, error) {
+	images := []ClusterImage{}
+	err := lister.list("pods", func(namespace string, opts v1.ListOptions) error {
+		podList, err := lister.clientset.CoreV1().Pods(namespace).List(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		for _, pod := range podList.Items {
+			// The runtime reports the resolved manifest digest, which catches
+			// tags that were moved after the pod was started.
+			digests := map[string]string{}
+			statuses := append([]corev1.ContainerStatus{}, pod.Status.ContainerStatuses...)
+			statuses = append(statuses, pod.Status.InitContainerStatuses...)
+			statuses = append(statuses, pod.Status.EphemeralContainerStatuses...)
+			for _, status := range statuses {
+				if _, digest, found := strings.Cut(status.ImageID, "@"); found {
+					digests[status.Name] = digest
+				}
+			}
+
+			records := workloadImages("Pod", pod.ObjectMeta, podSpecImages(pod.Spec))
+			names := podSpecContainerNames(pod.Spec)
+			for i := range records {
+				records[i].Digest = digests[names[i]]
+			}
+			images = append(images, records...)
+		}
+		return nil
+	})
+	return images, err
 }
 
-func (h clusterHelper) getPodImages(clientset *kubernetes.Clientset) []string {
+// podSpecImages returns the images of every container list of spec.
+func podSpecImages(spec corev1.PodSpec) []string {
 	images := []string{}
-	podList, err := clientset.CoreV1().Pods("").List(context.Background(), v1.ListOptions{})
-	if err != nil {
-		logrus.Fatal(err)
+	for _, container := range spec.InitContainers {
+		images = append(images, container.Image)
 	}
-	for _, pod := range podList.Items {
-		for _, container := range pod.Spec.Containers {
-			images = append(images, container.Image)
-		}
+	for _, container := range spec.Containers {
+		images = append(images, container.Image)
+	}
+	for _, container := range spec.EphemeralContainers {
+		images = append(images, container.Image)
 	}
 	return images
 }
 
-func (h clusterHelper) getControllerRevisionImages(clientset *kubernetes.Clientset) []string {
-	images := []string{}
-	controllerRevisionList, err := clientset.AppsV1().ControllerRevisions("").List(context.Background(), v1.ListOptions{})
-	if err != nil {
-		logrus.Fatal(err)
+// podSpecContainerNames returns the container names in the order of
+// podSpecImages.
+func podSpecContainerNames(spec corev1.PodSpec) []string {
+	names := []string{}
+	for _, container := range spec.InitContainers {
+		names = append(names, container.Name)
+	}
+	for _, container := range spec.Containers {
+		names = append(names, container.Name)
 	}
-	for _, cr := range controllerRevisionList.Items {
-		sts := appsv1.StatefulSet{}
-		err := json.Unmarshal(cr.Data.Raw, &sts)
+	for _, container := range spec.EphemeralContainers {
+		names = append(names, container.Name)
+	}
+	return names
+}
+
+func (h clusterHelper) getControllerRevisionImages(lister *scopedLister) ([]ClusterImage, error) {
+	images := []ClusterImage{}
+	err := lister.list("controllerrevisions", func(namespace string, opts v1.ListOptions) error {
+		controllerRevisionList, err := lister.clientset.AppsV1().ControllerRevisions(namespace).List(context.Background(), opts)
 		if err != nil {
-			logrus.Fatal(err)
+			return err
 		}
+		for _, cr := range controllerRevisionList.Items {
+			sts := appsv1.StatefulSet{}
+			if err := json.Unmarshal(cr.Data.Raw, &sts); err != nil {
+				return fmt.Errorf("failed to parse controllerrevision %s/%s: %w", cr.Namespace, cr.Name, err)
+			}
 
-		for _, container := range sts.Spec.Template.Spec.Containers {
-			images = append(images, container.Image)
+			images = append(images, workloadImages("ControllerRevision", cr.ObjectMeta, podSpecImages(sts.Spec.Template.Spec))...)
 		}
-	}
-	return images
+		return nil
+	})
+	return images, err
 }
 
-func (h clusterHelper) getReplicaSetImages(clientset *kubernetes.Clientset) []string {
-	images := []string{}
-	replicasetList, err := clientset.AppsV1().ReplicaSets("").List(context.Background(), v1.ListOptions{})
-	if err != nil {
-		logrus.Fatal(err)
-	}
-	for _, rs := range replicasetList.Items {
-		for _, container := range rs.Spec.Template.Spec.Containers {
-			images = append(images, container.Image)
+func (h clusterHelper) getReplicaSetImages(lister *scopedLister) ([]ClusterImage, error) {
+	images := []ClusterImage{}
+	err := lister.list("replicasets", func(namespace string, opts v1.ListOptions) error {
+		replicasetList, err := lister.clientset.AppsV1().ReplicaSets(namespace).List(context.Background(), opts)
+		if err != nil {
+			return err
 		}
-	}
-	return images
+		for _, rs := range replicasetList.Items {
+			images = append(images, workloadImages("ReplicaSet", rs.ObjectMeta, podSpecImages(rs.Spec.Template.Spec))...)
+		}
+		return nil
+	})
+	return images, err
+}
+
+func (h clusterHelper) getDeploymentImages(lister *scopedLister) ([]ClusterImage, error) {
+	images := []ClusterImage{}
+	err := lister.list("deployments", func(namespace string, opts v1.ListOptions) error {
+		deploymentList, err := lister.clientset.AppsV1().Deployments(namespace).List(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		for _, deployment := range deploymentList.Items {
+			images = append(images, workloadImages("Deployment", deployment.ObjectMeta, podSpecImages(deployment.Spec.Template.Spec))...)
+		}
+		return nil
+	})
+	return images, err
 }
 
-func (h clusterHelper) cleanImageNames(images []string) []string {
+func (h clusterHelper) getStatefulSetImages(lister *scopedLister) ([]ClusterImage, error) {
+	images := []ClusterImage{}
+	err := lister.list("statefulsets", func(namespace string, opts v1.ListOptions) error {
+		statefulSetList, err := lister.clientset.AppsV1().StatefulSets(namespace).List(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		for _, sts := range statefulSetList.Items {
+			images = append(images, workloadImages("StatefulSet", sts.ObjectMeta, podSpecImages(sts.Spec.Template.Spec))...)
+		}
+		return nil
+	})
+	return images, err
+}
+
+func (h clusterHelper) getDaemonSetImages(lister *scopedLister) ([]ClusterImage, error) {
+	images := []ClusterImage{}
+	err := lister.list("daemonsets", func(namespace string, opts v1.ListOptions) error {
+		daemonSetList, err := lister.clientset.AppsV1().DaemonSets(namespace).List(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		for _, ds := range daemonSetList.Items {
+			images = append(images, workloadImages("DaemonSet", ds.ObjectMeta, podSpecImages(ds.Spec.Template.Spec))...)
+		}
+		return nil
+	})
+	return images, err
+}
+
+func (h clusterHelper) getJobImages(lister *scopedLister) ([]ClusterImage, error) {
+	images := []ClusterImage{}
+	err := lister.list("jobs", func(namespace string, opts v1.ListOptions) error {
+		jobList, err := lister.clientset.BatchV1().Jobs(namespace).List(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		for _, job := range jobList.Items {
+			images = append(images, workloadImages("Job", job.ObjectMeta, podSpecImages(job.Spec.Template.Spec))...)
+		}
+		return nil
+	})
+	return images, err
+}
+
+func (h clusterHelper) getCronJobImages(lister *scopedLister) ([]ClusterImage, error) {
+	images := []ClusterImage{}
+	err := lister.list("cronjobs", func(namespace string, opts v1.ListOptions) error {
+		cronJobList, err := lister.clientset.BatchV1().CronJobs(namespace).List(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		for _, cronJob := range cronJobList.Items {
+			images = append(images, workloadImages("CronJob", cronJob.ObjectMeta, podSpecImages(cronJob.Spec.JobTemplate.Spec.Template.Spec))...)
+		}
+		return nil
+	})
+	return images, err
+}
+
+// cleanImageNames splits references into their tag and digest forms, so
+// "repo:tag@sha256:..." yields both "repo:tag" and "repo@sha256:...". A
+// reference without either pulls latest, which is how the registry lists it.
+func cleanImageNames(images []string) []string {
 	imgs := []string{}
 	for _, img := range images {
-		img = strings.Split(img, "@")[0]
-		imgs = append(imgs, img)
+		repo, tag, digest := splitReference(img)
+		switch {
+		case tag != "":
+			imgs = append(imgs, repo+":"+tag)
+		case digest == "":
+			imgs = append(imgs, repo+":latest")
+		}
+		if digest != "" {
+			imgs = append(imgs, repo+"@"+digest)
+		}
 	}
 
-	return imgs
+	return utils.Unique(imgs)
 }
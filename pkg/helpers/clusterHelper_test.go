@@ -0,0 +1,250 @@
+package helpers
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestImageRefs(t *testing.T) {
+	tests := []struct {
+		name   string
+		images []ClusterImage
+		want   []string
+	}{
+		{
+			name:   "tag",
+			images: []ClusterImage{{Image: "registry.test/app:1.0"}},
+			want:   []string{"registry.test/app:1.0"},
+		},
+		{
+			name:   "tag with the digest of the runtime",
+			images: []ClusterImage{{Image: "registry.test/app:1.0", Digest: "sha256:abc"}},
+			want:   []string{"registry.test/app:1.0", "registry.test/app@sha256:abc"},
+		},
+		{
+			name:   "tag and digest",
+			images: []ClusterImage{{Image: "registry.test/app:1.0@sha256:abc"}},
+			want:   []string{"registry.test/app:1.0", "registry.test/app@sha256:abc"},
+		},
+		{
+			name:   "registry port without a tag",
+			images: []ClusterImage{{Image: "registry.test:5000/app", Digest: "sha256:abc"}},
+			want:   []string{"registry.test:5000/app:latest", "registry.test:5000/app@sha256:abc"},
+		},
+		{
+			name:   "template without a tag or digest",
+			images: []ClusterImage{{Image: "registry.test/app"}},
+			want:   []string{"registry.test/app:latest"},
+		},
+		{
+			name:   "digest without a tag",
+			images: []ClusterImage{{Image: "registry.test/app@sha256:abc"}},
+			want:   []string{"registry.test/app@sha256:abc"},
+		},
+		{
+			name:   "scheme",
+			images: []ClusterImage{{Image: "docker://registry.test:5000/app:1.0@sha256:abc"}},
+			want:   []string{"registry.test:5000/app:1.0", "registry.test:5000/app@sha256:abc"},
+		},
+		{
+			name:   "duplicates",
+			images: []ClusterImage{{Image: "registry.test/app:1.0", Digest: "sha256:abc"}, {Image: "registry.test/app@sha256:abc"}},
+			want:   []string{"registry.test/app:1.0", "registry.test/app@sha256:abc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ImageRefs(tt.images)
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("ImageRefs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// controlledBy makes the object controlled by an owner of kind and name.
+func controlledBy(namespace, name, kind, owner string) v1.ObjectMeta {
+	controller := true
+	return v1.ObjectMeta{
+		Namespace:       namespace,
+		Name:            name,
+		OwnerReferences: []v1.OwnerReference{{Kind: kind, Name: owner, Controller: &controller}},
+	}
+}
+
+func podTemplate(images ...string) corev1.PodTemplateSpec {
+	spec := corev1.PodSpec{InitContainers: []corev1.Container{{Name: "init", Image: images[0]}}}
+	for _, image := range images[1:] {
+		spec.Containers = append(spec.Containers, corev1.Container{Name: "main", Image: image})
+	}
+	return corev1.PodTemplateSpec{Spec: spec}
+}
+
+func TestClusterHelperTemplateImages(t *testing.T) {
+	h := NewClusterHelper("")
+	statefulSet, _ := json.Marshal(appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Template: podTemplate("registry.test/init:1.0", "registry.test/db:1.0")}})
+	tests := []struct {
+		name   string
+		get    func(lister *scopedLister) ([]ClusterImage, error)
+		object runtime.Object
+		want   []ClusterImage
+	}{
+		{
+			// The job only exists while it runs, the images must be kept
+			// between runs.
+			name: "cronjob",
+			get:  h.getCronJobImages,
+			object: &batchv1.CronJob{
+				ObjectMeta: v1.ObjectMeta{Namespace: "batch", Name: "nightly"},
+				Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{
+					Template: podTemplate("registry.test/migrate:1.0", "registry.test/nightly"),
+				}}},
+			},
+			want: []ClusterImage{
+				{Image: "registry.test/migrate:1.0", Namespace: "batch", OwnerKind: "CronJob", OwnerName: "nightly"},
+				{Image: "registry.test/nightly", Namespace: "batch", OwnerKind: "CronJob", OwnerName: "nightly"},
+			},
+		},
+		{
+			name: "job of a cronjob",
+			get:  h.getJobImages,
+			object: &batchv1.Job{
+				ObjectMeta: controlledBy("batch", "nightly-28000000", "CronJob", "nightly"),
+				Spec:       batchv1.JobSpec{Template: podTemplate("registry.test/migrate:1.0", "registry.test/nightly:1.0")},
+			},
+			want: []ClusterImage{
+				{Image: "registry.test/migrate:1.0", Namespace: "batch", OwnerKind: "CronJob", OwnerName: "nightly"},
+				{Image: "registry.test/nightly:1.0", Namespace: "batch", OwnerKind: "CronJob", OwnerName: "nightly"},
+			},
+		},
+		{
+			name: "deployment scaled to zero",
+			get:  h.getDeploymentImages,
+			object: &appsv1.Deployment{
+				ObjectMeta: v1.ObjectMeta{Namespace: "web", Name: "api"},
+				Spec:       appsv1.DeploymentSpec{Replicas: new(int32), Template: podTemplate("registry.test/init:1.0", "registry.test/api:1.0")},
+			},
+			want: []ClusterImage{
+				{Image: "registry.test/init:1.0", Namespace: "web", OwnerKind: "Deployment", OwnerName: "api"},
+				{Image: "registry.test/api:1.0", Namespace: "web", OwnerKind: "Deployment", OwnerName: "api"},
+			},
+		},
+		{
+			name: "replicaset of a deployment",
+			get:  h.getReplicaSetImages,
+			object: &appsv1.ReplicaSet{
+				ObjectMeta: controlledBy("web", "api-5d4f", "Deployment", "api"),
+				Spec:       appsv1.ReplicaSetSpec{Template: podTemplate("registry.test/init:0.9", "registry.test/api:0.9")},
+			},
+			want: []ClusterImage{
+				{Image: "registry.test/init:0.9", Namespace: "web", OwnerKind: "Deployment", OwnerName: "api"},
+				{Image: "registry.test/api:0.9", Namespace: "web", OwnerKind: "Deployment", OwnerName: "api"},
+			},
+		},
+		{
+			name: "statefulset",
+			get:  h.getStatefulSetImages,
+			object: &appsv1.StatefulSet{
+				ObjectMeta: v1.ObjectMeta{Namespace: "data", Name: "db"},
+				Spec:       appsv1.StatefulSetSpec{Template: podTemplate("registry.test/init:1.0", "registry.test/db:1.0")},
+			},
+			want: []ClusterImage{
+				{Image: "registry.test/init:1.0", Namespace: "data", OwnerKind: "StatefulSet", OwnerName: "db"},
+				{Image: "registry.test/db:1.0", Namespace: "data", OwnerKind: "StatefulSet", OwnerName: "db"},
+			},
+		},
+		{
+			name: "controllerrevision of a statefulset",
+			get:  h.getControllerRevisionImages,
+			object: &appsv1.ControllerRevision{
+				ObjectMeta: controlledBy("data", "db-7c9", "StatefulSet", "db"),
+				Data:       runtime.RawExtension{Raw: statefulSet},
+			},
+			want: []ClusterImage{
+				{Image: "registry.test/init:1.0", Namespace: "data", OwnerKind: "StatefulSet", OwnerName: "db"},
+				{Image: "registry.test/db:1.0", Namespace: "data", OwnerKind: "StatefulSet", OwnerName: "db"},
+			},
+		},
+		{
+			name: "daemonset",
+			get:  h.getDaemonSetImages,
+			object: &appsv1.DaemonSet{
+				ObjectMeta: v1.ObjectMeta{Namespace: "system", Name: "agent"},
+				Spec:       appsv1.DaemonSetSpec{Template: podTemplate("registry.test/init:1.0", "registry.test/agent:1.0")},
+			},
+			want: []ClusterImage{
+				{Image: "registry.test/init:1.0", Namespace: "system", OwnerKind: "DaemonSet", OwnerName: "agent"},
+				{Image: "registry.test/agent:1.0", Namespace: "system", OwnerKind: "DaemonSet", OwnerName: "agent"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lister := newScopedLister(fake.NewSimpleClientset(tt.object), Scope{})
+			got, err := tt.get(lister)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("images = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterHelperPodImages(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: controlledBy("web", "api-5d4f-x2x", "ReplicaSet", "api-5d4f"),
+		Spec: corev1.PodSpec{
+			InitContainers:      []corev1.Container{{Name: "init", Image: "registry.test/init:1.0"}},
+			Containers:          []corev1.Container{{Name: "app", Image: "registry.test/api:1.0"}, {Name: "proxy", Image: "registry.test/proxy:2.0"}},
+			EphemeralContainers: []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "registry.test/debug"}}},
+		},
+		Status: corev1.PodStatus{
+			// Statuses are listed in any order, the proxy hasn't pulled yet.
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "proxy", ImageID: ""},
+				{Name: "app", ImageID: "registry.test/api@sha256:app"},
+			},
+			InitContainerStatuses:      []corev1.ContainerStatus{{Name: "init", ImageID: "docker-pullable://registry.test/init@sha256:init"}},
+			EphemeralContainerStatuses: []corev1.ContainerStatus{{Name: "debug", ImageID: "registry.test/debug@sha256:debug"}},
+		},
+	}
+	lister := newScopedLister(fake.NewSimpleClientset(pod), Scope{})
+	got, err := NewClusterHelper("").getPodImages(lister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ClusterImage{
+		{Image: "registry.test/init:1.0", Digest: "sha256:init", Namespace: "web", OwnerKind: "ReplicaSet", OwnerName: "api-5d4f"},
+		{Image: "registry.test/api:1.0", Digest: "sha256:app", Namespace: "web", OwnerKind: "ReplicaSet", OwnerName: "api-5d4f"},
+		{Image: "registry.test/proxy:2.0", Namespace: "web", OwnerKind: "ReplicaSet", OwnerName: "api-5d4f"},
+		{Image: "registry.test/debug", Digest: "sha256:debug", Namespace: "web", OwnerKind: "ReplicaSet", OwnerName: "api-5d4f"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("images = %+v, want %+v", got, want)
+	}
+
+	refs := ImageRefs(got)
+	sort.Strings(refs)
+	wantRefs := []string{
+		"registry.test/api:1.0", "registry.test/api@sha256:app",
+		"registry.test/debug:latest", "registry.test/debug@sha256:debug",
+		"registry.test/init:1.0", "registry.test/init@sha256:init",
+		"registry.test/proxy:2.0",
+	}
+	if strings.Join(refs, ",") != strings.Join(wantRefs, ",") {
+		t.Errorf("ImageRefs() = %v, want %v", refs, wantRefs)
+	}
+}
@@ -0,0 +1,299 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/sirupsen/logrus"
+)
+
+// ecrBatchSize is the maximum number of image ids BatchDeleteImage accepts.
+const ecrBatchSize = 100
+
+// ecrHelper lists and deletes images through the ECR API rather than the
+// registry v2 API, which gets push time, size and last pull time in one call.
+type ecrHelper struct {
+	client     *ecr.Client
+	RegPrefix  string
+	registryID *string
+	dryRun     bool
+	metas      map[string]ImageMeta
+	lock       *sync.RWMutex
+
+	// PageSize is the number of repositories or images requested per page.
+	PageSize int
+	// RepositoryPrefix limits listing to repositories starting with it.
+	RepositoryPrefix string
+}
+
+// NewECRHelper creates a helper for the ECR registry at URL, which looks like
+// https://<account>.dkr.ecr.<region>.amazonaws.com. endpoint optionally
+// overrides the ECR API endpoint.
+func NewECRHelper(URL, endpoint string, dryRun bool) (*ecrHelper, error) {
+	u, err := url.ParseRequestURI(strings.TrimSuffix(URL, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	var registryID *string
+	var region string
+	// <account>.dkr.ecr.<region>.amazonaws.com
+	if parts := strings.Split(u.Hostname(), "."); len(parts) > 3 && parts[1] == "dkr" && parts[2] == "ecr" {
+		registryID = aws.String(parts[0])
+		region = parts[3]
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	client := ecr.NewFromConfig(cfg, func(o *ecr.Options) {
+		if o.Region == "" {
+			o.Region = region
+		}
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+
+	return &ecrHelper{
+		client:     client,
+		RegPrefix:  u.Host,
+		registryID: registryID,
+		dryRun:     dryRun,
+		metas:      map[string]ImageMeta{},
+		lock:       &sync.RWMutex{},
+		PageSize:   defaultPageSize,
+	}, nil
+}
+
+func (h ecrHelper) Prefix() string {
+	return h.RegPrefix
+}
+
+func (h ecrHelper) pageSize() *int32 {
+	if h.PageSize <= 0 || h.PageSize > 1000 {
+		return aws.Int32(1000)
+	}
+	return aws.Int32(int32(h.PageSize))
+}
+
+// WalkImages lists the tagged images of every repository with
+// DescribeRepositories and DescribeImages. The image details are kept, so
+// ImageMeta doesn't need to go back to the API.
+func (h ecrHelper) WalkImages(fn func(image string)) error {
+	repositories := ecr.NewDescribeRepositoriesPaginator(h.client, &ecr.DescribeRepositoriesInput{
+		RegistryId: h.registryID,
+		MaxResults: h.pageSize(),
+	})
+	for repositories.HasMorePages() {
+		page, err := repositories.NextPage(context.TODO())
+		if err != nil {
+			return fmt.Errorf("failed to describe repositories: %w", err)
+		}
+		for _, repository := range page.Repositories {
+			repo := aws.ToString(repository.RepositoryName)
+			if !strings.HasPrefix(repo, h.RepositoryPrefix) {
+				continue
+			}
+			if err := h.walkRepository(repo, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h ecrHelper) walkRepository(repo string, fn func(image string)) error {
+	images := ecr.NewDescribeImagesPaginator(h.client, &ecr.DescribeImagesInput{
+		RegistryId:     h.registryID,
+		RepositoryName: aws.String(repo),
+		Filter:         &types.DescribeImagesFilter{TagStatus: types.TagStatusTagged},
+		MaxResults:     h.pageSize(),
+	})
+	for images.HasMorePages() {
+		page, err := images.NextPage(context.TODO())
+		if err != nil {
+			return fmt.Errorf("failed to describe images of %s: %w", repo, err)
+		}
+		for _, detail := range page.ImageDetails {
+			meta, err := h.detailMeta(repo, detail)
+			if err != nil {
+				return err
+			}
+			for _, tag := range detail.ImageTags {
+				image := fmt.Sprintf("%s/%s:%s", h.RegPrefix, repo, tag)
+				h.lock.Lock()
+				h.metas[image] = *meta
+				h.lock.Unlock()
+				fn(image)
+			}
+		}
+	}
+	return nil
+}
+
+func (h ecrHelper) detailMeta(repo string, detail types.ImageDetail) (*ImageMeta, error) {
+	meta := &ImageMeta{
+		Created:   aws.ToTime(detail.ImagePushedAt),
+		TotalSize: uint64(aws.ToInt64(detail.ImageSizeInBytes)),
+		Digest:    aws.ToString(detail.ImageDigest),
+		// Never pulled images have no last pull time, which leaves it zero.
+		LastPulled: aws.ToTime(detail.LastRecordedPullTime),
+	}
+
+	switch aws.ToString(detail.ImageManifestMediaType) {
+	case mediaTypeDockerManifestList, mediaTypeOCIIndex:
+		children, err := h.indexChildren(repo, meta.Digest)
+		if err != nil {
+			return nil, err
+		}
+		meta.Children = children
+	}
+
+	return meta, nil
+}
+
+// indexChildren fetches a manifest list or OCI index to find its platform
+// manifests, DescribeImages only reports those as untagged images.
+func (h ecrHelper) indexChildren(repo, digest string) ([]string, error) {
+	out, err := h.client.BatchGetImage(context.TODO(), &ecr.BatchGetImageInput{
+		RegistryId:         h.registryID,
+		RepositoryName:     aws.String(repo),
+		ImageIds:           []types.ImageIdentifier{{ImageDigest: aws.String(digest)}},
+		AcceptedMediaTypes: []string{mediaTypeDockerManifestList, mediaTypeOCIIndex},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest %s@%s: %w", repo, digest, err)
+	}
+	if len(out.Images) == 0 {
+		return nil, fmt.Errorf("manifest %s@%s not found", repo, digest)
+	}
+
+	manifest := manifestResponse{}
+	if err := json.Unmarshal([]byte(aws.ToString(out.Images[0].ImageManifest)), &manifest); err != nil {
+		return nil, err
+	}
+	children := []string{}
+	for _, child := range manifest.Manifests {
+		children = append(children, child.Digest)
+	}
+	return children, nil
+}
+
+func (h ecrHelper) describeImage(image string) (*types.ImageDetail, error) {
+	repo, tag := splitImageTag(h, image)
+	out, err := h.client.DescribeImages(context.TODO(), &ecr.DescribeImagesInput{
+		RegistryId:     h.registryID,
+		RepositoryName: aws.String(repo),
+		ImageIds:       []types.ImageIdentifier{{ImageTag: aws.String(tag)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.ImageDetails) == 0 {
+		return nil, fmt.Errorf("image %s not found", image)
+	}
+	return &out.ImageDetails[0], nil
+}
+
+func (h ecrHelper) ResolveDigest(image string) (string, error) {
+	detail, err := h.describeImage(image)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(detail.ImageDigest), nil
+}
+
+func (h ecrHelper) ImageMeta(image string) (*ImageMeta, error) {
+	h.lock.RLock()
+	meta, ok := h.metas[image]
+	h.lock.RUnlock()
+	if ok {
+		return &meta, nil
+	}
+
+	detail, err := h.describeImage(image)
+	if err != nil {
+		logrus.WithField("image", image).Warn(err)
+		return nil, err
+	}
+
+	repo, _ := splitImageTag(h, image)
+	m, err := h.detailMeta(repo, *detail)
+	if err != nil {
+		logrus.WithField("image", image).Warn(err)
+		return nil, err
+	}
+	h.lock.Lock()
+	h.metas[image] = *m
+	h.lock.Unlock()
+	return m, nil
+}
+
+// DeleteDigests deletes the groups with BatchDeleteImage, sending up to 100
+// manifests per call.
+func (h ecrHelper) DeleteDigests(groups []DigestGroup) error {
+	byRepo := map[string][]types.ImageIdentifier{}
+	repos := []string{}
+	for _, group := range groups {
+		logFields := logrus.Fields{
+			"tags": group.Tags,
+		}
+		if len(group.Children) > 0 {
+			logFields["platforms"] = group.Children
+		}
+		if h.dryRun {
+			logrus.WithFields(logFields).Infof("Dry run, skipping delete of %s@%s on registry", group.Repository, group.Digest)
+			continue
+		}
+		logrus.WithFields(logFields).Warnf("Deleting %s@%s on registry", group.Repository, group.Digest)
+
+		if _, ok := byRepo[group.Repository]; !ok {
+			repos = append(repos, group.Repository)
+		}
+		for _, digest := range append([]string{group.Digest}, group.Children...) {
+			byRepo[group.Repository] = append(byRepo[group.Repository], types.ImageIdentifier{ImageDigest: aws.String(digest)})
+		}
+	}
+
+	errs := []error{}
+	for _, repo := range repos {
+		ids := byRepo[repo]
+		for start := 0; start < len(ids); start += ecrBatchSize {
+			end := start + ecrBatchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+			out, err := h.client.BatchDeleteImage(context.TODO(), &ecr.BatchDeleteImageInput{
+				RegistryId:     h.registryID,
+				RepositoryName: aws.String(repo),
+				ImageIds:       ids[start:end],
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete images in %s: %w", repo, err))
+				continue
+			}
+			for _, failure := range out.Failures {
+				digest := ""
+				if failure.ImageId != nil {
+					digest = aws.ToString(failure.ImageId.ImageDigest)
+				}
+				errs = append(errs, fmt.Errorf(
+					"failed to delete %s@%s: %s",
+					repo, digest, aws.ToString(failure.FailureReason),
+				))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,249 @@
+package helpers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeECR is the JSON API of ECR in memory, it pages with page numbers as
+// next tokens.
+type fakeECR struct {
+	mu      sync.Mutex
+	repos   []string
+	images  map[string][]fakeECRImage // repository
+	deleted []string
+	// failures are returned by BatchDeleteImage as they are.
+	failures []map[string]interface{}
+	calls    map[string]int
+}
+
+type fakeECRImage struct {
+	Digest string
+	Tags   []string
+	Pushed time.Time
+	Size   int64
+}
+
+func newFakeECR(t *testing.T) (*fakeECR, *ecrHelper) {
+	f := &fakeECR{
+		images: map[string][]fakeECRImage{},
+		calls:  map[string]int{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	h, err := NewECRHelper("https://123456789012.dkr.ecr.eu-west-1.amazonaws.com", server.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, h
+}
+
+func (f *fakeECR) push(repo string, image fakeECRImage) {
+	if _, ok := f.images[repo]; !ok {
+		f.repos = append(f.repos, repo)
+	}
+	f.images[repo] = append(f.images[repo], image)
+}
+
+func (f *fakeECR) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var input struct {
+		RepositoryName string `json:"repositoryName"`
+		NextToken      string `json:"nextToken"`
+		MaxResults     int    `json:"maxResults"`
+		ImageIDs       []struct {
+			ImageDigest string `json:"imageDigest"`
+			ImageTag    string `json:"imageTag"`
+		} `json:"imageIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	operation := r.Header.Get("X-Amz-Target")
+	operation = operation[strings.LastIndex(operation, ".")+1:]
+	f.calls[operation]++
+
+	// page returns the bounds of the page of n items and its next token.
+	page := func(n int) (int, int, string) {
+		start, _ := strconv.Atoi(input.NextToken)
+		end := n
+		if input.MaxResults > 0 && start+input.MaxResults < n {
+			end = start + input.MaxResults
+		}
+		if end < n {
+			return start, end, strconv.Itoa(end)
+		}
+		return start, end, ""
+	}
+
+	output := map[string]interface{}{}
+	switch operation {
+	case "DescribeRepositories":
+		start, end, next := page(len(f.repos))
+		repositories := []map[string]interface{}{}
+		for _, repo := range f.repos[start:end] {
+			repositories = append(repositories, map[string]interface{}{"repositoryName": repo})
+		}
+		output["repositories"] = repositories
+		if next != "" {
+			output["nextToken"] = next
+		}
+	case "DescribeImages":
+		images := f.images[input.RepositoryName]
+		if len(input.ImageIDs) > 0 {
+			found := []fakeECRImage{}
+			for _, image := range images {
+				for _, tag := range image.Tags {
+					if tag == input.ImageIDs[0].ImageTag {
+						found = append(found, image)
+					}
+				}
+			}
+			images = found
+		}
+		start, end, next := page(len(images))
+		details := []map[string]interface{}{}
+		for _, image := range images[start:end] {
+			details = append(details, map[string]interface{}{
+				"repositoryName":         input.RepositoryName,
+				"imageDigest":            image.Digest,
+				"imageTags":              image.Tags,
+				"imagePushedAt":          image.Pushed.Unix(),
+				"imageSizeInBytes":       image.Size,
+				"imageManifestMediaType": mediaTypeDockerManifest,
+			})
+		}
+		output["imageDetails"] = details
+		if next != "" {
+			output["nextToken"] = next
+		}
+	case "BatchDeleteImage":
+		for _, id := range input.ImageIDs {
+			f.deleted = append(f.deleted, input.RepositoryName+"@"+id.ImageDigest)
+		}
+		output["imageIds"] = input.ImageIDs
+		output["failures"] = f.failures
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(output)
+}
+
+func TestECRHelperWalkImages(t *testing.T) {
+	pushed := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	f, h := newFakeECR(t)
+	f.push("team/app", fakeECRImage{Digest: "sha256:a1", Tags: []string{"1.0", "latest"}, Pushed: pushed, Size: 10})
+	f.push("team/app", fakeECRImage{Digest: "sha256:a2", Tags: []string{"0.9"}, Pushed: pushed, Size: 20})
+	f.push("other/app", fakeECRImage{Digest: "sha256:b1", Tags: []string{"1.0"}, Pushed: pushed, Size: 30})
+	f.push("team/web", fakeECRImage{Digest: "sha256:c1", Tags: []string{"2.0"}, Pushed: pushed, Size: 40})
+	h.PageSize = 1
+	h.RepositoryPrefix = "team/"
+
+	images := []string{}
+	if err := h.WalkImages(func(image string) { images = append(images, image) }); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		h.Prefix() + "/team/app:1.0",
+		h.Prefix() + "/team/app:latest",
+		h.Prefix() + "/team/app:0.9",
+		h.Prefix() + "/team/web:2.0",
+	}
+	if strings.Join(images, ",") != strings.Join(want, ",") {
+		t.Errorf("WalkImages() = %v, want %v", images, want)
+	}
+
+	// The details of the walk are reused.
+	calls := f.calls["DescribeImages"]
+	meta, err := h.ImageMeta(h.Prefix() + "/team/app:0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Digest != "sha256:a2" || meta.TotalSize != 20 || !meta.Created.Equal(pushed) {
+		t.Errorf("ImageMeta() = %+v", meta)
+	}
+	if f.calls["DescribeImages"] != calls {
+		t.Errorf("ImageMeta() described the image again")
+	}
+
+	if dgst, err := h.ResolveDigest(h.Prefix() + "/team/web:2.0"); err != nil || dgst != "sha256:c1" {
+		t.Errorf("ResolveDigest() = %s, %v, want sha256:c1", dgst, err)
+	}
+	if _, err := h.ImageMeta(h.Prefix() + "/team/web:missing"); err == nil {
+		t.Errorf("ImageMeta() of a missing tag, want an error")
+	}
+}
+
+func TestECRHelperDeleteDigests(t *testing.T) {
+	groups := []DigestGroup{
+		{Repository: "app", Digest: "sha256:a1", Tags: []string{"1.0"}},
+		{Repository: "app", Digest: "sha256:a2", Tags: []string{"0.9"}, Children: []string{"sha256:a3"}},
+	}
+	tests := []struct {
+		name     string
+		dryRun   bool
+		failures []map[string]interface{}
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name: "deletes digests and platform manifests",
+			want: []string{"app@sha256:a1", "app@sha256:a2", "app@sha256:a3"},
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+		},
+		{
+			name: "failures are errors",
+			failures: []map[string]interface{}{
+				{"imageId": map[string]string{"imageDigest": "sha256:a1"}, "failureCode": "ImageNotFound", "failureReason": "not found"},
+			},
+			want:    []string{"app@sha256:a1", "app@sha256:a2", "app@sha256:a3"},
+			wantErr: true,
+		},
+		{
+			name: "failures without an image id",
+			failures: []map[string]interface{}{
+				{"failureCode": "InvalidImageDigest", "failureReason": "invalid"},
+			},
+			want:    []string{"app@sha256:a1", "app@sha256:a2", "app@sha256:a3"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, h := newFakeECR(t)
+			f.failures = tt.failures
+			h.dryRun = tt.dryRun
+
+			err := h.DeleteDigests(groups)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeleteDigests() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			sort.Strings(f.deleted)
+			if strings.Join(f.deleted, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("deleted %v, want %v", f.deleted, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package helpers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Expression is a compiled CEL condition an image has to meet to be deleted.
+// It sees these variables:
+//
+//	repo        string             repository, without the registry host
+//	tag         string
+//	digest      string
+//	created     timestamp
+//	age         duration           time since created
+//	size        int                total size in bytes
+//	labels      map(string,string) labels of the image config
+//	lastPulled  timestamp          zero when the registry doesn't record pulls
+//	repoInUse   bool               another tag of the repository runs in a cluster
+type Expression struct {
+	source  string
+	program cel.Program
+}
+
+// NewExpression compiles source, which has to evaluate to a bool.
+func NewExpression(source string) (*Expression, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("repo", cel.StringType),
+		cel.Variable("tag", cel.StringType),
+		cel.Variable("digest", cel.StringType),
+		cel.Variable("created", cel.TimestampType),
+		cel.Variable("age", cel.DurationType),
+		cel.Variable("size", cel.IntType),
+		cel.Variable("labels", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("lastPulled", cel.TimestampType),
+		cel.Variable("repoInUse", cel.BoolType),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(source)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", source, issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("invalid expression %q: evaluates to %s, expected bool", source, ast.OutputType())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", source, err)
+	}
+	return &Expression{source: source, program: program}, nil
+}
+
+// Eval evaluates the expression for an image.
+func (e Expression) Eval(repo, tag string, meta *ImageMeta, repoInUse bool) (bool, error) {
+	labels := meta.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	out, _, err := e.program.Eval(map[string]interface{}{
+		"repo":       repo,
+		"tag":        tag,
+		"digest":     meta.Digest,
+		"created":    meta.Created,
+		"age":        time.Since(meta.Created),
+		"size":       int64(meta.TotalSize),
+		"labels":     labels,
+		"lastPulled": meta.LastPulled,
+		"repoInUse":  repoInUse,
+	})
+	if err != nil {
+		return false, err
+	}
+	result, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q returned %v, expected bool", e.source, out.Value())
+	}
+	return result, nil
+}
+
+func (e Expression) String() string {
+	return e.source
+}
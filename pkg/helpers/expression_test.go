@@ -0,0 +1,96 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+const exampleExpression = `repo.startsWith("ci/") && age > duration("72h") && !tag.matches("^release-")`
+
+func TestNewExpression(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		wantErr bool
+	}{
+		{name: "example", source: exampleExpression},
+		{name: "labels and usage", source: `labels["team"] == "a" && !repoInUse && size > 1024`},
+		{name: "syntax error", source: `repo.startsWith("ci/") &&`, wantErr: true},
+		{name: "unknown variable", source: `owner == "a"`, wantErr: true},
+		{name: "not a bool", source: `size * 2`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewExpression(tt.source)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewExpression() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpressionEval(t *testing.T) {
+	e, err := NewExpression(exampleExpression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	week := &ImageMeta{Created: time.Now().AddDate(0, 0, -7)}
+	tests := []struct {
+		name string
+		repo string
+		tag  string
+		meta *ImageMeta
+		want bool
+	}{
+		{name: "matches", repo: "ci/app", tag: "pr-1", meta: week, want: true},
+		{name: "other repository", repo: "app", tag: "pr-1", meta: week},
+		{name: "too young", repo: "ci/app", tag: "pr-1", meta: &ImageMeta{Created: time.Now()}},
+		{name: "release", repo: "ci/app", tag: "release-1", meta: week},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := e.Eval(tt.repo, tt.tag, tt.meta, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterImageWhere(t *testing.T) {
+	old := time.Now().AddDate(0, 0, -60)
+	tests := []struct {
+		name       string
+		where      string
+		labels     map[string]string
+		wantDelete bool
+		wantReason string
+	}{
+		{name: "matches", where: `labels["team"] == "a"`, labels: map[string]string{"team": "a"}, wantDelete: true, wantReason: "delete"},
+		{name: "doesn't match", where: `labels["team"] == "a"`, labels: map[string]string{"team": "b"}, wantReason: "where"},
+		// Missing map keys only fail when evaluated.
+		{name: "evaluation error", where: `labels["team"] == "a"`, wantReason: "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewExpression(tt.where)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reg := newFakeRegistry()
+			image := reg.add("app", "1.0", ImageMeta{Created: old, Labels: tt.labels})
+			h := NewFilterHelper(reg)
+			h.Where = e
+
+			if got := h.FilterImage(image); got != tt.wantDelete {
+				t.Errorf("FilterImage() = %v, want %v", got, tt.wantDelete)
+			}
+			if d, _ := h.Decision(image); d.Reason != tt.wantReason {
+				t.Errorf("Decision() = %+v, want %s", d, tt.wantReason)
+			}
+		})
+	}
+}
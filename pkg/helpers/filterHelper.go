@@ -1,83 +1,451 @@
 package helpers
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
-	"k8s.io/utils/strings/slices"
+	"golang.org/x/mod/semver"
 )
 
 type filterHelper struct {
-	rh                 *regHelper
-	ExcludeNameFilters []string
-	IncludeNameFilters []string
-	MinAge             int
+	reg                 Registry
+	ExcludeRepositories []Matcher
+	IncludeRepositories []Matcher
+	ExcludeTags         []Matcher
+	IncludeTags         []Matcher
+	MinAge              int
+	KeepLast            int
+	KeepSemverMinors    int
+	// KeepLabels keeps images whose config labels match, DeleteLabels only
+	// deletes images whose labels match.
+	KeepLabels   *LabelSelector
+	DeleteLabels *LabelSelector
+	// Policy holds per-repository rules that take precedence over MinAge
+	// and KeepLast for the images they match.
+	Policy *Policy
+	// Where is an extra condition images have to meet to be deleted.
+	Where      *Expression
+	stats      map[string]int
+	decisions  map[string]Decision
+	inUseRepos map[string]bool
 }
 
-func NewFilterHelper(rh regHelper) *filterHelper {
+// Decision records which policy rule and which filter decided on an image.
+// Rule is empty when no policy rule matched the image.
+type Decision struct {
+	Rule   string
+	Reason string
+}
+
+func NewFilterHelper(reg Registry) *filterHelper {
 	return &filterHelper{
-		rh: &rh,
+		reg: reg,
+		stats: map[string]int{
+			"exclude_repo":  0,
+			"include_repo":  0,
+			"exclude_tag":   0,
+			"include_tag":   0,
+			"min_age":       0,
+			"keep_last":     0,
+			"semver":        0,
+			"policy_keep":   0,
+			"protected":     0,
+			"where":         0,
+			"keep_labels":   0,
+			"delete_labels": 0,
+			"error":         0,
+			"delete":        0,
+		},
+		decisions:  map[string]Decision{},
+		inUseRepos: map[string]bool{},
 	}
 }
 
-func (h filterHelper) FilterImages(images []string) ([]string, int) {
-	filtered := []string{}
-
-	stringContains := func(img string) func(s string) bool {
-		return func(s string) bool {
-			return !strings.Contains(img, s)
+// MarkInUse remembers the repositories of the registry that images, as found
+// in the clusters, belong to.
+func (h filterHelper) MarkInUse(images []string) {
+	prefix := h.reg.Prefix() + "/"
+	for _, image := range images {
+		if !strings.HasPrefix(image, prefix) {
+			continue
 		}
+		repo, _, _ := strings.Cut(strings.TrimPrefix(image, prefix), "@")
+		repo, _, _ = strings.Cut(repo, ":")
+		h.inUseRepos[repo] = true
 	}
+}
+
+// record counts the reason image was kept or deleted for and remembers it.
+func (h filterHelper) record(image string, rule *PolicyRule, reason string) {
+	h.stats[reason]++
+	h.decide(image, rule, reason)
+}
+
+// decide remembers the reason image was kept or deleted for.
+func (h filterHelper) decide(image string, rule *PolicyRule, reason string) {
+	d := Decision{Reason: reason}
+	if rule != nil {
+		d.Rule = rule.Name
+	}
+	h.decisions[image] = d
+}
+
+// Decision returns how image was decided on by the filters.
+func (h filterHelper) Decision(image string) (Decision, bool) {
+	d, ok := h.decisions[image]
+	return d, ok
+}
 
-	stats := map[string]int{
-		"exclude_name": 0,
-		"include_name": 0,
-		"min_age":      0,
-		"error":        0,
+// Forget drops the decisions on images once they are no longer needed, so
+// memory doesn't grow with the size of the registry.
+func (h filterHelper) Forget(images []string) {
+	for _, image := range images {
+		delete(h.decisions, image)
 	}
+}
+
+func (h filterHelper) LogFilters() {
 	logrus.WithFields(logrus.Fields{
-		"exclude_name": h.ExcludeNameFilters,
-		"include_name": h.IncludeNameFilters,
-		"min_age":      h.MinAge,
+		"exclude_repo":  h.ExcludeRepositories,
+		"include_repo":  h.IncludeRepositories,
+		"exclude_tag":   h.ExcludeTags,
+		"include_tag":   h.IncludeTags,
+		"min_age":       h.MinAge,
+		"keep_last":     h.KeepLast,
+		"semver":        h.KeepSemverMinors,
+		"policy_rules":  len(h.policyRules()),
+		"where":         h.Where,
+		"keep_labels":   h.KeepLabels,
+		"delete_labels": h.DeleteLabels,
 	}).Debugf("Filters")
-	for _, image := range images {
-		img, _ := h.rh.splitImageTag(image)
+	for _, rule := range h.policyRules() {
+		logrus.WithFields(logrus.Fields{
+			"repositories": rule.Repositories,
+			"tags":         rule.Tags,
+			"action":       rule.Action,
+			"min_age":      rule.MinAge,
+			"keep_last":    rule.KeepLast,
+			"protected":    rule.ProtectedTags,
+		}).Debugf("Policy rule %s", rule.Name)
+	}
+}
 
-		// Filter by include-name-filters
-		if len(h.IncludeNameFilters) > 0 && len(slices.Filter(nil, h.IncludeNameFilters, stringContains(img))) == len(h.IncludeNameFilters) {
-			logrus.Tracef("Image %s filtered by include filter, skipping", img)
-			stats["include_name"]++
-			continue
+// FilterImage reports whether image passes all filters and can be deleted.
+func (h filterHelper) FilterImage(image string) bool {
+	img, tag := splitImageTag(h.reg, image)
+
+	// Filter by include-repo
+	if len(h.IncludeRepositories) > 0 && !matchAny(h.IncludeRepositories, img) {
+		logrus.Tracef("Image %s filtered by include filter, skipping", img)
+		h.record(image, nil, "include_repo")
+		return false
+	}
+
+	// Filter by exclude-repo
+	if matchAny(h.ExcludeRepositories, img) {
+		logrus.Tracef("Image %s filtered by exclude filter, skipping", img)
+		h.record(image, nil, "exclude_repo")
+		return false
+	}
+
+	// Filter by include-tag
+	if len(h.IncludeTags) > 0 && !matchAny(h.IncludeTags, tag) {
+		logrus.Tracef("Image %s filtered by include tag filter, skipping", image)
+		h.record(image, nil, "include_tag")
+		return false
+	}
+
+	// Filter by exclude-tag
+	if matchAny(h.ExcludeTags, tag) {
+		logrus.Tracef("Image %s filtered by exclude tag filter, skipping", image)
+		h.record(image, nil, "exclude_tag")
+		return false
+	}
+
+	// Filter by policy, the first matching rule decides
+	minAge := h.MinAge
+	rule := h.Policy.Match(img, tag)
+	if rule != nil {
+		if rule.Action == PolicyActionKeep {
+			logrus.Tracef("Image %s is kept by policy rule %s, skipping", image, rule.Name)
+			h.record(image, rule, "policy_keep")
+			return false
 		}
+		if rule.Protects(tag) {
+			logrus.Tracef("Image %s is protected by policy rule %s, skipping", image, rule.Name)
+			h.record(image, rule, "protected")
+			return false
+		}
+		if rule.MinAge != nil {
+			minAge = *rule.MinAge
+		}
+	}
 
-		// Filter by exclude-name-filters
-		if len(h.ExcludeNameFilters) > 0 && len(slices.Filter(nil, h.ExcludeNameFilters, stringContains(img))) != len(h.ExcludeNameFilters) {
-			logrus.Tracef("Image %s filtered by exclude filter, skipping", img)
-			stats["exclude_name"]++
-			continue
+	meta, err := h.reg.ImageMeta(image)
+	if err != nil {
+		logrus.Tracef("Failed to get image date for %s, skipping", image)
+		h.record(image, rule, "error")
+		return false
+	}
+
+	// Filter by labels
+	if h.KeepLabels != nil && h.KeepLabels.Matches(meta.Labels) {
+		logrus.Tracef("Image %s matches keep labels %s, skipping", image, h.KeepLabels)
+		h.record(image, rule, "keep_labels")
+		return false
+	}
+	if h.DeleteLabels != nil && !h.DeleteLabels.Matches(meta.Labels) {
+		logrus.Tracef("Image %s doesn't match delete labels %s, skipping", image, h.DeleteLabels)
+		h.record(image, rule, "delete_labels")
+		return false
+	}
+
+	// Filter by minimum age
+	if meta.Created.After(time.Now().AddDate(0, 0, -minAge)) {
+		logrus.Tracef("Image %s is younger than %d days, skipping", image, minAge)
+		h.record(image, rule, "min_age")
+		return false
+	}
+
+	// Filter by expression
+	if h.Where != nil {
+		ok, err := h.Where.Eval(img, tag, meta, h.inUseRepos[img])
+		if err != nil {
+			logrus.Tracef("Failed to evaluate expression for %s: %s, skipping", image, err)
+			h.record(image, rule, "error")
+			return false
 		}
+		if !ok {
+			logrus.Tracef("Image %s doesn't match expression, skipping", image)
+			h.record(image, rule, "where")
+			return false
+		}
+	}
+	// Keep-last, semver and shared digests may still keep the image, it is
+	// counted once its digest is deleted.
+	h.decide(image, rule, "delete")
+	return true
+}
+
+// CountDeleted counts the images of the groups that are deleted.
+func (h filterHelper) CountDeleted(groups []DigestGroup) {
+	for _, group := range groups {
+		h.stats["delete"] += len(group.Images)
+	}
+}
+
+// Stats returns how many images every filter decided on.
+func (h filterHelper) Stats() map[string]int {
+	stats := map[string]int{}
+	for k, v := range h.stats {
+		stats[k] = v
+	}
+	return stats
+}
+
+// DeleteReason describes why FilterImage let image be deleted.
+func (h filterHelper) DeleteReason(image string) string {
+	rule := h.matchRule(image)
+	minAge := h.MinAge
+	if rule != nil && rule.MinAge != nil {
+		minAge = *rule.MinAge
+	}
 
-		// Filter by minimum age
-		created, err := h.rh.GetImageDate(image)
-		if err == nil && created.After(time.Now().AddDate(0, 0, -h.MinAge)) {
-			logrus.Tracef("Image %s is younger than %d days, skipping", image, h.MinAge)
-			stats["min_age"]++
+	reasons := []string{"not in use", fmt.Sprintf("older than %d days", minAge)}
+	if rule != nil {
+		reasons = append(reasons, "policy rule "+rule.Name)
+	}
+	if h.DeleteLabels != nil {
+		reasons = append(reasons, "labels match "+h.DeleteLabels.String())
+	}
+	if h.Where != nil {
+		reasons = append(reasons, "matches "+h.Where.String())
+	}
+	return strings.Join(reasons, ", ")
+}
+
+func (h filterHelper) matchRule(image string) *PolicyRule {
+	img, tag := splitImageTag(h.reg, image)
+	return h.Policy.Match(img, tag)
+}
+
+func (h filterHelper) policyRules() []PolicyRule {
+	if h.Policy == nil {
+		return nil
+	}
+	return h.Policy.Rules
+}
+
+func (h filterHelper) LogStats() {
+	logrus.WithFields(logrus.Fields{
+		"exclude_repo":  h.stats["exclude_repo"],
+		"include_repo":  h.stats["include_repo"],
+		"exclude_tag":   h.stats["exclude_tag"],
+		"include_tag":   h.stats["include_tag"],
+		"min_age":       h.stats["min_age"],
+		"keep_last":     h.stats["keep_last"],
+		"semver":        h.stats["semver"],
+		"policy_keep":   h.stats["policy_keep"],
+		"protected":     h.stats["protected"],
+		"where":         h.stats["where"],
+		"keep_labels":   h.stats["keep_labels"],
+		"delete_labels": h.stats["delete_labels"],
+		"error":         h.stats["error"],
+		"delete":        h.stats["delete"],
+	}).Debug("Filter stats")
+}
+
+// KeepLastImages keeps the KeepLast newest images of every repository, in use
+// or not. Images matched by a policy rule with its own keep-last are counted
+// separately, per repository and rule. images holds every image in the
+// registry, the images of toDelete that are kept are returned separately from
+// the ones left to delete.
+func (h filterHelper) KeepLastImages(images, toDelete []string) ([]string, []string) {
+	if h.KeepLast <= 0 && !h.Policy.setsKeepLast() {
+		return toDelete, []string{}
+	}
+
+	type dated struct {
+		image   string
+		created time.Time
+	}
+	type group struct {
+		repo     string
+		rule     *PolicyRule
+		keepLast int
+	}
+	byGroup := map[group][]dated{}
+	for _, image := range images {
+		meta, err := h.reg.ImageMeta(image)
+		if err != nil {
 			continue
-		} else if err != nil {
-			logrus.Tracef("Failed to get image date for %s, skipping", image)
-			stats["error"]++
+		}
+		img, tag := splitImageTag(h.reg, image)
+		g := group{repo: img, keepLast: h.KeepLast}
+		if rule := h.Policy.Match(img, tag); rule != nil && rule.KeepLast != nil {
+			g.rule, g.keepLast = rule, *rule.KeepLast
+		}
+		if g.keepLast <= 0 {
+			continue
+		}
+		byGroup[g] = append(byGroup[g], dated{image, meta.Created})
+	}
+
+	keep := map[string]bool{}
+	for g, repoImages := range byGroup {
+		sort.SliceStable(repoImages, func(i, j int) bool {
+			return repoImages[i].created.After(repoImages[j].created)
+		})
+		for i := 0; i < g.keepLast && i < len(repoImages); i++ {
+			keep[repoImages[i].image] = true
+		}
+		logrus.Tracef("Keeping the %d newest images of %s", g.keepLast, g.repo)
+	}
+
+	filtered := []string{}
+	kept := []string{}
+	for _, image := range toDelete {
+		if keep[image] {
+			logrus.Tracef("Image %s is one of the newest, skipping", image)
+			h.record(image, h.matchRule(image), "keep_last")
+			kept = append(kept, image)
 			continue
 		}
 		filtered = append(filtered, image)
 	}
+	return filtered, kept
+}
 
-	logrus.WithFields(logrus.Fields{
-		"exclude_name": stats["exclude_name"],
-		"include_name": stats["include_name"],
-		"min_age":      stats["min_age"],
-        "error":        stats["error"],
-	}).Debug("Filter stats")
+// KeepSemverImages keeps the latest patch release of the last KeepSemverMinors
+// minor versions of every repository, along with a newer pre-release of that
+// patch. Pre-releases of a version that has a final release are not kept and
+// tags that aren't semantic versions are left to the other filters. Like
+// KeepLastImages, it returns the images left to delete and the ones it kept.
+func (h filterHelper) KeepSemverImages(images, toDelete []string) ([]string, []string) {
+	if h.KeepSemverMinors <= 0 {
+		return toDelete, []string{}
+	}
+
+	type version struct {
+		image   string
+		version string
+	}
+	byRepo := map[string][]version{}
+	for _, image := range images {
+		img, tag := splitImageTag(h.reg, image)
+		v := tag
+		if !strings.HasPrefix(v, "v") {
+			v = "v" + v
+		}
+		// Shortened versions like v1.4 are valid to semver, which would take
+		// dates and build numbers for versions as well.
+		if !semver.IsValid(v) || semver.Canonical(v) != strings.TrimSuffix(v, semver.Build(v)) {
+			continue
+		}
+		byRepo[img] = append(byRepo[img], version{image, semver.Canonical(v)})
+	}
+
+	keep := map[string]bool{}
+	for img, versions := range byRepo {
+		sort.SliceStable(versions, func(i, j int) bool {
+			return semver.Compare(versions[i].version, versions[j].version) > 0
+		})
+
+		finals := map[string]bool{}
+		for _, v := range versions {
+			if semver.Prerelease(v.version) == "" {
+				finals[v.version] = true
+			}
+		}
 
-	return filtered, len(images) - len(filtered)
+		// versions is sorted newest first, so the first final release of a
+		// minor is its latest patch and pre-releases before it are newer.
+		minors := []string{}
+		latest := map[string]string{}
+		keptPrerelease := map[string]bool{}
+		for _, v := range versions {
+			minor := semver.MajorMinor(v.version)
+			if _, ok := latest[minor]; !ok {
+				if len(minors) == h.KeepSemverMinors {
+					logrus.Tracef("Semver %s: %s is older than the last %d minor versions", img, v.image, h.KeepSemverMinors)
+					continue
+				}
+				minors = append(minors, minor)
+				latest[minor] = ""
+			}
+
+			prerelease := semver.Prerelease(v.version)
+			release := strings.TrimSuffix(v.version, prerelease)
+			switch {
+			case prerelease != "" && finals[release]:
+				logrus.Tracef("Semver %s: %s is a pre-release of released %s, dropping", img, v.image, release)
+			case prerelease != "" && latest[minor] == "" && !keptPrerelease[minor]:
+				logrus.Tracef("Semver %s: keeping %s as latest pre-release of %s", img, v.image, minor)
+				keptPrerelease[minor] = true
+				keep[v.image] = true
+			case prerelease == "" && (latest[minor] == "" || latest[minor] == v.version):
+				logrus.Tracef("Semver %s: keeping %s as latest patch of %s", img, v.image, minor)
+				latest[minor] = v.version
+				keep[v.image] = true
+			default:
+				logrus.Tracef("Semver %s: %s is superseded in %s", img, v.image, minor)
+			}
+		}
+	}
+
+	filtered := []string{}
+	kept := []string{}
+	for _, image := range toDelete {
+		if keep[image] {
+			logrus.Tracef("Image %s is kept by the semver rule, skipping", image)
+			h.record(image, h.matchRule(image), "semver")
+			kept = append(kept, image)
+			continue
+		}
+		filtered = append(filtered, image)
+	}
+	return filtered, kept
 }
@@ -0,0 +1,216 @@
+package helpers
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeepSemverImages(t *testing.T) {
+	tests := []struct {
+		name   string
+		minors int
+		tags   []string
+		want   []string
+	}{
+		{
+			name:   "latest patch of the last minors",
+			minors: 2,
+			tags:   []string{"1.2.0", "1.2.1", "1.3.0", "v1.3.2", "1.1.9", "latest"},
+			want:   []string{"1.2.1", "v1.3.2"},
+		},
+		{
+			name:   "newer pre-release of a minor",
+			minors: 1,
+			tags:   []string{"1.3.0", "1.3.1-rc.1", "1.3.0-rc.1"},
+			want:   []string{"1.3.0", "1.3.1-rc.1"},
+		},
+		{
+			name:   "build metadata",
+			minors: 1,
+			tags:   []string{"1.3.0+build.1", "1.2.0"},
+			want:   []string{"1.3.0+build.1"},
+		},
+		{
+			name:   "shortened versions are not semver",
+			minors: 1,
+			tags:   []string{"1.2.0", "v1", "v1.4", "2"},
+			want:   []string{"1.2.0"},
+		},
+		{
+			name:   "dates and build numbers are not semver",
+			minors: 1,
+			tags:   []string{"20240101", "42", "1.0.0"},
+			want:   []string{"1.0.0"},
+		},
+		{
+			name:   "disabled",
+			minors: 0,
+			tags:   []string{"1.2.0"},
+			want:   []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newFakeRegistry()
+			images := []string{}
+			for _, tag := range tt.tags {
+				images = append(images, reg.add("app", tag, ImageMeta{}))
+			}
+			h := NewFilterHelper(reg)
+			h.KeepSemverMinors = tt.minors
+
+			toDelete, kept := h.KeepSemverImages(images, images)
+			got := []string{}
+			for _, image := range kept {
+				_, tag := splitImageTag(reg, image)
+				got = append(got, tag)
+			}
+			sort.Strings(got)
+			want := append([]string{}, tt.want...)
+			sort.Strings(want)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("kept %v, want %v", got, want)
+			}
+			if len(toDelete)+len(kept) != len(images) {
+				t.Errorf("%d left to delete and %d kept of %d images", len(toDelete), len(kept), len(images))
+			}
+		})
+	}
+}
+
+func TestKeepLastImages(t *testing.T) {
+	type image struct {
+		tag string
+		day int
+		// inUse images are never offered for deletion, but count toward N.
+		inUse bool
+	}
+	keepOne := 1
+	tests := []struct {
+		name     string
+		keepLast int
+		policy   *Policy
+		// images in the order the registry lists them.
+		images []image
+		want   []string
+	}{
+		{
+			name:     "newest by creation date",
+			keepLast: 2,
+			images:   []image{{tag: "b", day: 2}, {tag: "a", day: 4}, {tag: "d", day: 1}, {tag: "c", day: 3}},
+			want:     []string{"a", "c"},
+		},
+		{
+			name:     "in use images count",
+			keepLast: 2,
+			images:   []image{{tag: "a", day: 4, inUse: true}, {tag: "b", day: 3}, {tag: "c", day: 2}, {tag: "d", day: 1}},
+			want:     []string{"b"},
+		},
+		{
+			name:     "rules keep their own count",
+			keepLast: 2,
+			policy: &Policy{Rules: []PolicyRule{
+				{Name: "pull requests", Tags: []string{"pr-*"}, KeepLast: &keepOne},
+			}},
+			images: []image{{tag: "a", day: 4}, {tag: "b", day: 3}, {tag: "c", day: 2}, {tag: "pr-1", day: 5}, {tag: "pr-2", day: 1}},
+			want:   []string{"a", "b", "pr-1"},
+		},
+		{
+			name:   "rules alone",
+			policy: &Policy{Rules: []PolicyRule{{Tags: []string{"pr-*"}, KeepLast: &keepOne}}},
+			images: []image{{tag: "a", day: 4}, {tag: "pr-1", day: 5}, {tag: "pr-2", day: 1}},
+			want:   []string{"pr-1"},
+		},
+		{
+			name:   "disabled",
+			images: []image{{tag: "a", day: 4}},
+			want:   []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.policy != nil {
+				if err := tt.policy.compile(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			reg := newFakeRegistry()
+			images, toDelete := []string{}, []string{}
+			for _, img := range tt.images {
+				image := reg.add("app", img.tag, ImageMeta{Created: time.Date(2023, 1, img.day, 0, 0, 0, 0, time.UTC)})
+				images = append(images, image)
+				if !img.inUse {
+					toDelete = append(toDelete, image)
+				}
+			}
+			h := NewFilterHelper(reg)
+			h.KeepLast = tt.keepLast
+			h.Policy = tt.policy
+
+			left, kept := h.KeepLastImages(images, toDelete)
+			got := []string{}
+			for _, image := range kept {
+				_, tag := splitImageTag(reg, image)
+				got = append(got, tag)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+			if len(left)+len(kept) != len(toDelete) {
+				t.Errorf("%d left to delete and %d kept of %d images", len(left), len(kept), len(toDelete))
+			}
+		})
+	}
+}
+
+func TestFilterHelperStats(t *testing.T) {
+	old := time.Now().AddDate(0, 0, -60)
+	reg := newFakeRegistry()
+	images := []string{
+		reg.add("app", "1.0", ImageMeta{Digest: "sha256:a1", Created: old.AddDate(0, 0, -1)}),
+		// 1.1 is kept as one of the last two, after 2.0.
+		reg.add("app", "1.1", ImageMeta{Digest: "sha256:a2", Created: old}),
+		// latest is excluded and shares its digest with 1.2, which keeps both.
+		reg.add("app", "1.2", ImageMeta{Digest: "sha256:a3", Created: old.AddDate(0, 0, -2)}),
+		reg.add("app", "latest", ImageMeta{Digest: "sha256:a3", Created: old.AddDate(0, 0, -2)}),
+		reg.add("app", "2.0", ImageMeta{Digest: "sha256:a4", Created: time.Now()}),
+	}
+	h := NewFilterHelper(reg)
+	h.MinAge = 30
+	h.KeepLast = 2
+	h.ExcludeTags = []Matcher{{pattern: "latest"}}
+
+	toDelete := []string{}
+	for _, image := range images {
+		if h.FilterImage(image) {
+			toDelete = append(toDelete, image)
+		}
+	}
+	toDelete, _ = h.KeepLastImages(images, toDelete)
+	deleteSet := map[string]bool{}
+	for _, image := range toDelete {
+		deleteSet[image] = true
+	}
+	groups := []DigestGroup{}
+	for _, group := range GroupByDigest(reg, images) {
+		deletable := true
+		for _, image := range group.Images {
+			deletable = deletable && deleteSet[image]
+		}
+		if deletable {
+			groups = append(groups, group)
+		}
+	}
+	h.CountDeleted(groups)
+
+	stats := h.Stats()
+	want := map[string]int{"delete": 1, "keep_last": 1, "min_age": 1, "exclude_tag": 1}
+	for reason, count := range want {
+		if stats[reason] != count {
+			t.Errorf("stats[%s] = %d, want %d", reason, stats[reason], count)
+		}
+	}
+}
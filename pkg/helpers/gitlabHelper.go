@@ -0,0 +1,290 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// gitlabHelper lists and deletes images through the GitLab container registry
+// API, for instances where the registry v2 catalog is disabled.
+type gitlabHelper struct {
+	client    *http.Client
+	apiURL    string
+	scope     string
+	token     string
+	RegPrefix string
+	dryRun    bool
+	repos     map[string]gitlabRepository
+	metas     map[string]ImageMeta
+	lock      *sync.RWMutex
+
+	// PageSize is the number of repositories or tags requested per page.
+	PageSize int
+	// RepositoryPrefix limits listing to repositories starting with it.
+	RepositoryPrefix string
+}
+
+type gitlabRepository struct {
+	ID        int    `json:"id"`
+	ProjectID int    `json:"project_id"`
+	Path      string `json:"path"`
+	Location  string `json:"location"`
+}
+
+type gitlabTag struct {
+	Name      string    `json:"name"`
+	Digest    string    `json:"digest"`
+	CreatedAt time.Time `json:"created_at"`
+	TotalSize int64     `json:"total_size"`
+}
+
+// NewGitlabHelper creates a helper for the GitLab instance at URL. The path of
+// URL selects what to clean, either "/projects/<id>" or "/groups/<id>", where
+// the id can also be the URL encoded full path.
+func NewGitlabHelper(URL, token string, dryRun bool) (*gitlabHelper, error) {
+	u, err := url.ParseRequestURI(strings.TrimSuffix(URL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	scope := u.EscapedPath()
+	if parts := strings.Split(scope, "/"); len(parts) != 3 || (parts[1] != "projects" && parts[1] != "groups") || parts[2] == "" {
+		return nil, fmt.Errorf("GitLab registry URL %s must end in /projects/<id> or /groups/<id>", URL)
+	}
+	u.Path, u.RawPath = "", ""
+
+	h := &gitlabHelper{
+		client:   &http.Client{},
+		apiURL:   u.String() + "/api/v4",
+		scope:    scope,
+		token:    token,
+		dryRun:   dryRun,
+		repos:    map[string]gitlabRepository{},
+		metas:    map[string]ImageMeta{},
+		lock:     &sync.RWMutex{},
+		PageSize: defaultPageSize,
+	}
+
+	// The registry lives on its own host, which only shows in the location
+	// of a repository.
+	repos := []gitlabRepository{}
+	if _, err := h.request("GET", h.scope+"/registry/repositories?per_page=1", &repos); err != nil {
+		return nil, fmt.Errorf("failed to list repositories of %s: %w", URL, err)
+	}
+	if len(repos) == 0 {
+		return nil, fmt.Errorf("%s has no container repositories to find the registry host in", URL)
+	}
+	h.RegPrefix = strings.TrimSuffix(repos[0].Location, "/"+repos[0].Path)
+	if h.RegPrefix == "" || h.RegPrefix == repos[0].Location {
+		return nil, fmt.Errorf("can't find the registry host in location %q of %s", repos[0].Location, repos[0].Path)
+	}
+
+	return h, nil
+}
+
+func (h gitlabHelper) Prefix() string {
+	return h.RegPrefix
+}
+
+func (h gitlabHelper) request(method, path string, response interface{}) (*http.Response, error) {
+	req, err := http.NewRequest(method, h.apiURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.token != "" {
+		req.Header.Set("PRIVATE-TOKEN", h.token)
+	}
+
+	logrus.Tracef("gitlab.request method=%s url=%s", method, req.URL)
+	return doJSON(h.client, req, response)
+}
+
+// paginate requests path page by page, following the X-Next-Page header.
+func (h gitlabHelper) paginate(path string, newPage func() interface{}, handle func(page interface{})) error {
+	pageSize := h.PageSize
+	if pageSize <= 0 || pageSize > 100 {
+		pageSize = 100
+	}
+
+	page := "1"
+	for page != "" {
+		response := newPage()
+		resp, err := h.request("GET", fmt.Sprintf("%s?per_page=%d&page=%s", path, pageSize, page), response)
+		if err != nil {
+			return err
+		}
+		handle(response)
+		page = resp.Header.Get("X-Next-Page")
+	}
+	return nil
+}
+
+// WalkImages lists the repositories of the project or group and the tags of
+// each of them. Tag details are only fetched by ImageMeta.
+func (h gitlabHelper) WalkImages(fn func(image string)) error {
+	repos, err := h.repositories()
+	if err != nil {
+		return fmt.Errorf("failed to list repositories: %w", err)
+	}
+
+	for _, repo := range repos {
+		err := h.paginate(h.repositoryPath(repo)+"/tags", func() interface{} {
+			return &[]gitlabTag{}
+		}, func(page interface{}) {
+			for _, tag := range *page.(*[]gitlabTag) {
+				fn(fmt.Sprintf("%s/%s:%s", h.RegPrefix, repo.Path, tag.Name))
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list tags of %s: %w", repo.Path, err)
+		}
+	}
+	return nil
+}
+
+// repositories lists the repositories under RepositoryPrefix and remembers
+// their ids for the tag requests.
+func (h gitlabHelper) repositories() ([]gitlabRepository, error) {
+	repos := []gitlabRepository{}
+	err := h.paginate(h.scope+"/registry/repositories", func() interface{} {
+		return &[]gitlabRepository{}
+	}, func(page interface{}) {
+		for _, repo := range *page.(*[]gitlabRepository) {
+			if strings.HasPrefix(repo.Path, h.RepositoryPrefix) {
+				repos = append(repos, repo)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, repo := range repos {
+		h.repos[repo.Path] = repo
+	}
+	return repos, nil
+}
+
+func (h gitlabHelper) repositoryPath(repo gitlabRepository) string {
+	return fmt.Sprintf("/projects/%d/registry/repositories/%d", repo.ProjectID, repo.ID)
+}
+
+func (h gitlabHelper) tagPath(image string) (string, error) {
+	path, tag := splitImageTag(h, image)
+	h.lock.RLock()
+	repo, ok := h.repos[path]
+	h.lock.RUnlock()
+	if !ok {
+		// Images looked up without walking the registry first.
+		if _, err := h.repositories(); err != nil {
+			return "", err
+		}
+		h.lock.RLock()
+		repo, ok = h.repos[path]
+		h.lock.RUnlock()
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown repository %s", path)
+	}
+	return h.repositoryPath(repo) + "/tags/" + url.PathEscape(tag), nil
+}
+
+func (h gitlabHelper) tag(image string) (*gitlabTag, error) {
+	path, err := h.tagPath(image)
+	if err != nil {
+		return nil, err
+	}
+	tag := &gitlabTag{}
+	if _, err := h.request("GET", path, tag); err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+func (h gitlabHelper) ResolveDigest(image string) (string, error) {
+	tag, err := h.tag(image)
+	if err != nil {
+		return "", err
+	}
+	return tag.Digest, nil
+}
+
+func (h gitlabHelper) ImageMeta(image string) (*ImageMeta, error) {
+	h.lock.RLock()
+	meta, ok := h.metas[image]
+	h.lock.RUnlock()
+	if ok {
+		return &meta, nil
+	}
+
+	tag, err := h.tag(image)
+	if err != nil {
+		logrus.WithField("image", image).Warn(err)
+		return nil, err
+	}
+	meta = ImageMeta{
+		Created:   tag.CreatedAt,
+		TotalSize: uint64(tag.TotalSize),
+		Digest:    tag.Digest,
+	}
+	h.lock.Lock()
+	h.metas[image] = meta
+	h.lock.Unlock()
+	return &meta, nil
+}
+
+// DeleteDigests deletes every tag of the groups through the tags API, GitLab
+// cleans up the untagged manifests during its own garbage collection.
+func (h gitlabHelper) DeleteDigests(groups []DigestGroup) error {
+	errs := []error{}
+	for _, group := range groups {
+		if err := h.deleteDigest(group); err != nil {
+			errs = append(errs, fmt.Errorf("%s@%s: %w", group.Repository, group.Digest, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h gitlabHelper) deleteDigest(group DigestGroup) error {
+	logFields := logrus.Fields{
+		"tags": group.Tags,
+	}
+
+	// Tags are deleted by name, one pushed again since it was resolved
+	// would take an image nobody decided on along.
+	for _, image := range group.Images {
+		current, err := h.ResolveDigest(image)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", image, err)
+		}
+		if current != group.Digest {
+			return fmt.Errorf("%s moved to %s, not deleting", image, current)
+		}
+	}
+
+	if h.dryRun {
+		logrus.WithFields(logFields).Infof("Dry run, skipping delete of %s@%s on registry", group.Repository, group.Digest)
+		return nil
+	}
+
+	logrus.WithFields(logFields).Warnf("Deleting %s@%s on registry", group.Repository, group.Digest)
+	errs := []error{}
+	for _, image := range group.Images {
+		path, err := h.tagPath(image)
+		if err == nil {
+			_, err = h.request("DELETE", path, nil)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", image, err))
+		}
+	}
+	return errors.Join(errs...)
+}
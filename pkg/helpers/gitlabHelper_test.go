@@ -0,0 +1,252 @@
+package helpers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGitlab is the container registry API of GitLab in memory, serving the
+// repositories of a single group.
+type fakeGitlab struct {
+	mu      sync.Mutex
+	scope   string
+	repos   []gitlabRepository
+	tags    map[int][]gitlabTag // repository id
+	deleted []string
+}
+
+func newFakeGitlab(t *testing.T) (*fakeGitlab, *httptest.Server) {
+	f := &fakeGitlab{
+		scope: "/groups/team",
+		tags:  map[int][]gitlabTag{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeGitlab) push(path string, tag gitlabTag) {
+	for _, repo := range f.repos {
+		if repo.Path == path {
+			f.tags[repo.ID] = append(f.tags[repo.ID], tag)
+			return
+		}
+	}
+	repo := gitlabRepository{ID: len(f.repos) + 1, ProjectID: 100 + len(f.repos), Path: path, Location: "registry.gitlab.test/" + path}
+	f.repos = append(f.repos, repo)
+	f.tags[repo.ID] = []gitlabTag{tag}
+}
+
+func (f *fakeGitlab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("PRIVATE-TOKEN") != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// page writes the page of items the query asks for and links the next.
+	page := func(items []interface{}) {
+		number, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil {
+			number = 1
+		}
+		size, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		start, end := (number-1)*size, number*size
+		if start > len(items) {
+			start = len(items)
+		}
+		if end < len(items) {
+			w.Header().Set("X-Next-Page", strconv.Itoa(number+1))
+		} else {
+			end = len(items)
+		}
+		json.NewEncoder(w).Encode(items[start:end])
+	}
+
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/v4")
+	if path == f.scope+"/registry/repositories" {
+		items := []interface{}{}
+		for _, repo := range f.repos {
+			items = append(items, repo)
+		}
+		page(items)
+		return
+	}
+
+	// /projects/<id>/registry/repositories/<id>/tags[/<name>]
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 6 || parts[0] != "projects" || parts[5] != "tags" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, _ := strconv.Atoi(parts[4])
+	if len(parts) == 6 {
+		items := []interface{}{}
+		for _, tag := range f.tags[id] {
+			items = append(items, tag)
+		}
+		page(items)
+		return
+	}
+	name, _ := url.PathUnescape(parts[6])
+	for i, tag := range f.tags[id] {
+		if tag.Name != name {
+			continue
+		}
+		if r.Method == http.MethodDelete {
+			f.deleted = append(f.deleted, parts[4]+":"+name)
+			f.tags[id] = append(f.tags[id][:i], f.tags[id][i+1:]...)
+			return
+		}
+		json.NewEncoder(w).Encode(tag)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func TestNewGitlabHelper(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		location string
+		empty    bool
+		wantErr  bool
+	}{
+		{name: "group", path: "/groups/team"},
+		{name: "project by path", path: "/projects/team%2Fapp"},
+		{name: "no scope", path: "", wantErr: true},
+		{name: "empty id", path: "/groups/", wantErr: true},
+		{name: "unknown scope", path: "/users/team", wantErr: true},
+		{name: "trailing path", path: "/groups/team/registry", wantErr: true},
+		{name: "no repositories", path: "/groups/team", empty: true, wantErr: true},
+		{name: "location without host", path: "/groups/team", location: "team/app", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, server := newFakeGitlab(t)
+			f.scope = tt.path
+			if !tt.empty {
+				f.push("team/app", gitlabTag{Name: "1.0"})
+			}
+			if tt.location != "" {
+				f.repos[0].Location = tt.location
+			}
+
+			h, err := NewGitlabHelper(server.URL+tt.path, "token", false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewGitlabHelper() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && h.Prefix() != "registry.gitlab.test" {
+				t.Errorf("Prefix() = %q, want registry.gitlab.test", h.Prefix())
+			}
+		})
+	}
+}
+
+func TestGitlabHelperWalkImages(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name             string
+		repositoryPrefix string
+		want             []string
+	}{
+		{
+			name: "all repositories",
+			want: []string{"team/app:0.9", "team/app:1.0", "team/app:latest", "team/web:2.0"},
+		},
+		{
+			name:             "repository prefix",
+			repositoryPrefix: "team/web",
+			want:             []string{"team/web:2.0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, server := newFakeGitlab(t)
+			for _, tag := range []string{"0.9", "1.0", "latest"} {
+				f.push("team/app", gitlabTag{Name: tag, Digest: "sha256:" + tag, CreatedAt: created, TotalSize: 10})
+			}
+			f.push("team/web", gitlabTag{Name: "2.0", Digest: "sha256:2.0", CreatedAt: created, TotalSize: 20})
+
+			h, err := NewGitlabHelper(server.URL+"/groups/team", "token", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Pages of one item make every listing follow X-Next-Page.
+			h.PageSize = 1
+			h.RepositoryPrefix = tt.repositoryPrefix
+
+			images := []string{}
+			if err := h.WalkImages(func(image string) { images = append(images, image) }); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{}
+			for _, image := range tt.want {
+				want = append(want, h.Prefix()+"/"+image)
+			}
+			if strings.Join(images, ",") != strings.Join(want, ",") {
+				t.Errorf("WalkImages() = %v, want %v", images, want)
+			}
+
+			meta, err := h.ImageMeta(want[len(want)-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Digest != "sha256:2.0" || meta.TotalSize != 20 || !meta.Created.Equal(created) {
+				t.Errorf("ImageMeta() = %+v", meta)
+			}
+		})
+	}
+}
+
+func TestGitlabHelperDeleteDigests(t *testing.T) {
+	tests := []struct {
+		name    string
+		dryRun  bool
+		tags    []string
+		move    bool
+		want    []string
+		wantErr bool
+	}{
+		{name: "deletes every tag", tags: []string{"1.0", "latest"}, want: []string{"1:1.0", "1:latest"}},
+		{name: "dry run", dryRun: true, tags: []string{"1.0", "latest"}},
+		{name: "missing tags are errors", tags: []string{"1.0", "missing"}, wantErr: true},
+		{name: "moved tags are not deleted", tags: []string{"1.0", "latest"}, move: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, server := newFakeGitlab(t)
+			f.push("team/app", gitlabTag{Name: "1.0", Digest: "sha256:a1"})
+			f.push("team/app", gitlabTag{Name: "latest", Digest: "sha256:a1"})
+			h, err := NewGitlabHelper(server.URL+"/groups/team", "token", tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			group := DigestGroup{Repository: "team/app", Digest: "sha256:a1", Tags: tt.tags}
+			for _, tag := range tt.tags {
+				group.Images = append(group.Images, h.Prefix()+"/team/app:"+tag)
+			}
+			if tt.move {
+				// latest is pushed again between planning and deleting.
+				f.tags[1][1].Digest = "sha256:b2"
+			}
+			err = h.DeleteDigests([]DigestGroup{group})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeleteDigests() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if strings.Join(f.deleted, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("deleted %v, want %v", f.deleted, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// harborHelper talks to the Harbor API, which returns push time, pull time,
+// size and tags of every artifact in one call. Deleting through the API also
+// keeps Harbor's own view of the artifacts in sync.
+type harborHelper struct {
+	client    *http.Client
+	apiURL    string
+	username  string
+	password  string
+	RegPrefix string
+	dryRun    bool
+	metas     map[string]ImageMeta
+	lock      *sync.RWMutex
+
+	// PageSize is the number of projects, repositories or artifacts
+	// requested per page.
+	PageSize int
+	// RepositoryPrefix limits listing to repositories starting with it, the
+	// first path segment selects the project.
+	RepositoryPrefix string
+	// GarbageCollect triggers a Harbor GC run after deleting artifacts.
+	GarbageCollect bool
+}
+
+type harborProject struct {
+	Name string `json:"name"`
+}
+
+type harborRepository struct {
+	Name string `json:"name"`
+}
+
+type harborArtifact struct {
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	PushTime time.Time `json:"push_time"`
+	PullTime time.Time `json:"pull_time"`
+	Tags     []struct {
+		Name string `json:"name"`
+	} `json:"tags"`
+	References []struct {
+		ChildDigest string `json:"child_digest"`
+	} `json:"references"`
+	ExtraAttrs struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	} `json:"extra_attrs"`
+}
+
+func NewHarborHelper(URL, username, password string, dryRun bool) (*harborHelper, error) {
+	URL = strings.TrimSuffix(URL, "/")
+	u, err := url.ParseRequestURI(URL)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &harborHelper{
+		client:    &http.Client{},
+		apiURL:    URL + "/api/v2.0",
+		username:  username,
+		password:  password,
+		RegPrefix: u.Host,
+		dryRun:    dryRun,
+		metas:     map[string]ImageMeta{},
+		lock:      &sync.RWMutex{},
+		PageSize:  defaultPageSize,
+	}
+
+	if _, err := h.request("GET", "/ping", nil, nil); err != nil {
+		return nil, fmt.Errorf("failed to reach harbor %s: %w", URL, err)
+	}
+
+	return h, nil
+}
+
+func (h harborHelper) Prefix() string {
+	return h.RegPrefix
+}
+
+func (h harborHelper) HasLabels() bool {
+	return true
+}
+
+func (h harborHelper) request(method, path string, body, response interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, h.apiURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if h.username != "" {
+		req.SetBasicAuth(h.username, h.password)
+	}
+
+	logrus.Tracef("harbor.request method=%s url=%s", method, req.URL)
+	return doJSON(h.client, req, response)
+}
+
+// paginate requests path page by page until a page comes back short.
+func (h harborHelper) paginate(path string, newPage func() interface{}, handle func(page interface{}) int) error {
+	pageSize := h.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	for page := 1; ; page++ {
+		response := newPage()
+		pagePath := fmt.Sprintf("%s%spage=%d&page_size=%d", path, sep, page, pageSize)
+		if _, err := h.request("GET", pagePath, nil, response); err != nil {
+			return err
+		}
+		if handle(response) < pageSize {
+			return nil
+		}
+	}
+}
+
+// repositoryPath builds the API path of a repository, Harbor expects the
+// repository name without its project and with slashes double encoded.
+func (h harborHelper) repositoryPath(repo string) string {
+	project, name, _ := strings.Cut(repo, "/")
+	return fmt.Sprintf(
+		"/projects/%s/repositories/%s",
+		url.PathEscape(project),
+		url.PathEscape(url.PathEscape(name)),
+	)
+}
+
+func (h harborHelper) projects() ([]string, error) {
+	if project, _, found := strings.Cut(h.RepositoryPrefix, "/"); found {
+		return []string{project}, nil
+	}
+
+	projects := []string{}
+	err := h.paginate("/projects", func() interface{} {
+		return &[]harborProject{}
+	}, func(page interface{}) int {
+		items := *page.(*[]harborProject)
+		for _, project := range items {
+			if strings.HasPrefix(project.Name, h.RepositoryPrefix) {
+				projects = append(projects, project.Name)
+			}
+		}
+		return len(items)
+	})
+	return projects, err
+}
+
+// WalkImages lists the artifacts of every repository, project by project.
+// The artifact details are kept, so ImageMeta doesn't need to go back to the
+// API.
+func (h harborHelper) WalkImages(fn func(image string)) error {
+	projects, err := h.projects()
+	if err != nil {
+		return fmt.Errorf("failed to list projects: %w", err)
+	}
+
+	for _, project := range projects {
+		repos := []string{}
+		err := h.paginate("/projects/"+url.PathEscape(project)+"/repositories", func() interface{} {
+			return &[]harborRepository{}
+		}, func(page interface{}) int {
+			items := *page.(*[]harborRepository)
+			for _, repo := range items {
+				if strings.HasPrefix(repo.Name, h.RepositoryPrefix) {
+					repos = append(repos, repo.Name)
+				}
+			}
+			return len(items)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list repositories of %s: %w", project, err)
+		}
+
+		for _, repo := range repos {
+			if err := h.walkArtifacts(repo, fn); err != nil {
+				return fmt.Errorf("failed to list artifacts of %s: %w", repo, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (h harborHelper) walkArtifacts(repo string, fn func(image string)) error {
+	return h.paginate(h.repositoryPath(repo)+"/artifacts?with_tag=true", func() interface{} {
+		return &[]harborArtifact{}
+	}, func(page interface{}) int {
+		items := *page.(*[]harborArtifact)
+		for _, artifact := range items {
+			meta := artifact.meta()
+			for _, tag := range artifact.Tags {
+				image := fmt.Sprintf("%s/%s:%s", h.RegPrefix, repo, tag.Name)
+				h.lock.Lock()
+				h.metas[image] = meta
+				h.lock.Unlock()
+				fn(image)
+			}
+		}
+		return len(items)
+	})
+}
+
+func (a harborArtifact) meta() ImageMeta {
+	meta := ImageMeta{
+		Created:    a.PushTime,
+		TotalSize:  uint64(a.Size),
+		Digest:     a.Digest,
+		LastPulled: a.PullTime,
+		Labels:     a.ExtraAttrs.Config.Labels,
+	}
+	for _, ref := range a.References {
+		meta.Children = append(meta.Children, ref.ChildDigest)
+	}
+	return meta
+}
+
+func (h harborHelper) artifact(image string) (*harborArtifact, error) {
+	repo, tag := splitImageTag(h, image)
+	artifact := &harborArtifact{}
+	if _, err := h.request("GET", h.repositoryPath(repo)+"/artifacts/"+url.PathEscape(tag), nil, artifact); err != nil {
+		return nil, err
+	}
+	return artifact, nil
+}
+
+func (h harborHelper) ResolveDigest(image string) (string, error) {
+	artifact, err := h.artifact(image)
+	if err != nil {
+		return "", err
+	}
+	return artifact.Digest, nil
+}
+
+func (h harborHelper) ImageMeta(image string) (*ImageMeta, error) {
+	h.lock.RLock()
+	meta, ok := h.metas[image]
+	h.lock.RUnlock()
+	if ok {
+		return &meta, nil
+	}
+
+	artifact, err := h.artifact(image)
+	if err != nil {
+		logrus.WithField("image", image).Warn(err)
+		return nil, err
+	}
+	meta = artifact.meta()
+	h.lock.Lock()
+	h.metas[image] = meta
+	h.lock.Unlock()
+	return &meta, nil
+}
+
+// DeleteDigests deletes the artifacts through the Harbor API. Harbor removes
+// the platform manifests of an index itself once nothing references them.
+func (h harborHelper) DeleteDigests(groups []DigestGroup) error {
+	errs := []error{}
+	deleted := 0
+	for _, group := range groups {
+		logFields := logrus.Fields{
+			"tags": group.Tags,
+		}
+		if len(group.Children) > 0 {
+			logFields["platforms"] = group.Children
+		}
+		if h.dryRun {
+			logrus.WithFields(logFields).Infof("Dry run, skipping delete of %s@%s on registry", group.Repository, group.Digest)
+			continue
+		}
+
+		logrus.WithFields(logFields).Warnf("Deleting %s@%s on registry", group.Repository, group.Digest)
+		if _, err := h.request("DELETE", h.repositoryPath(group.Repository)+"/artifacts/"+group.Digest, nil, nil); err != nil {
+			errs = append(errs, fmt.Errorf("%s@%s: %w", group.Repository, group.Digest, err))
+			continue
+		}
+		deleted++
+	}
+
+	if h.GarbageCollect && deleted > 0 {
+		if err := h.triggerGC(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to trigger garbage collection: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h harborHelper) triggerGC() error {
+	logrus.Info("Triggering Harbor garbage collection")
+	_, err := h.request("POST", "/system/gc/schedule", map[string]interface{}{
+		"schedule": map[string]string{
+			"type": "Manual",
+		},
+		"parameters": map[string]interface{}{
+			"delete_untagged": false,
+			"workers":         1,
+		},
+	}, nil)
+	return err
+}
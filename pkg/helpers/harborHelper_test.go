@@ -0,0 +1,289 @@
+package helpers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHarbor is the Harbor API in memory.
+type fakeHarbor struct {
+	mu        sync.Mutex
+	artifacts map[string][]harborArtifact // project/repository
+	deleted   []string
+	gcRuns    int
+	requests  []string
+}
+
+func newFakeHarbor(t *testing.T) (*fakeHarbor, *harborHelper) {
+	f := &fakeHarbor{artifacts: map[string][]harborArtifact{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	h, err := NewHarborHelper(server.URL, "admin", "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, h
+}
+
+func (f *fakeHarbor) push(repo, digest string, pushed time.Time, size int64, tags ...string) {
+	artifact := harborArtifact{Digest: digest, Size: size, PushTime: pushed}
+	for _, tag := range tags {
+		artifact.Tags = append(artifact.Tags, struct {
+			Name string `json:"name"`
+		}{Name: tag})
+	}
+	f.artifacts[repo] = append(f.artifacts[repo], artifact)
+}
+
+// sorted returns the keys of set in order, projects and repositories are
+// listed by name.
+func sorted(set map[string]bool) []string {
+	keys := []string{}
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeHarbor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if user, password, _ := r.BasicAuth(); user != "admin" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2.0")
+	f.requests = append(f.requests, r.Method+" "+path)
+
+	// page writes the page of items the query asks for.
+	page := func(items []interface{}) {
+		number, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		size, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+		start, end := (number-1)*size, number*size
+		if start > len(items) {
+			start = len(items)
+		}
+		if end > len(items) {
+			end = len(items)
+		}
+		json.NewEncoder(w).Encode(items[start:end])
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "/ping":
+		w.Write([]byte("Pong"))
+	case path == "/system/gc/schedule" && r.Method == http.MethodPost:
+		f.gcRuns++
+		w.WriteHeader(http.StatusCreated)
+	case path == "/projects":
+		projects := map[string]bool{}
+		for repo := range f.artifacts {
+			project, _, _ := strings.Cut(repo, "/")
+			projects[project] = true
+		}
+		items := []interface{}{}
+		for _, project := range sorted(projects) {
+			items = append(items, harborProject{Name: project})
+		}
+		page(items)
+	case len(parts) == 3 && parts[2] == "repositories":
+		repos := map[string]bool{}
+		for repo := range f.artifacts {
+			if strings.HasPrefix(repo, parts[1]+"/") {
+				repos[repo] = true
+			}
+		}
+		items := []interface{}{}
+		for _, repo := range sorted(repos) {
+			items = append(items, harborRepository{Name: repo})
+		}
+		page(items)
+	case len(parts) >= 5 && parts[4] == "artifacts":
+		name, _ := url.PathUnescape(parts[3])
+		repo := parts[1] + "/" + name
+		if len(parts) == 5 {
+			items := []interface{}{}
+			for _, artifact := range f.artifacts[repo] {
+				items = append(items, artifact)
+			}
+			page(items)
+			return
+		}
+		for i, artifact := range f.artifacts[repo] {
+			found := artifact.Digest == parts[5]
+			for _, tag := range artifact.Tags {
+				found = found || tag.Name == parts[5]
+			}
+			if !found {
+				continue
+			}
+			if r.Method == http.MethodDelete {
+				f.deleted = append(f.deleted, repo+"@"+artifact.Digest)
+				f.artifacts[repo] = append(f.artifacts[repo][:i], f.artifacts[repo][i+1:]...)
+				return
+			}
+			json.NewEncoder(w).Encode(artifact)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestHarborHelperWalkImages(t *testing.T) {
+	pushed := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name             string
+		repositoryPrefix string
+		want             []string
+		// listsProjects is whether the projects are listed at all.
+		listsProjects bool
+	}{
+		{
+			name:          "all projects",
+			want:          []string{"other/app:1.0", "team/app:1.0", "team/app:latest", "team/app:0.9", "team/group/web:2.0"},
+			listsProjects: true,
+		},
+		{
+			name:             "project scoped",
+			repositoryPrefix: "team/",
+			want:             []string{"team/app:1.0", "team/app:latest", "team/app:0.9", "team/group/web:2.0"},
+		},
+		{
+			name:             "repository prefix",
+			repositoryPrefix: "team/group",
+			want:             []string{"team/group/web:2.0"},
+		},
+		{
+			name:             "project prefix",
+			repositoryPrefix: "oth",
+			want:             []string{"other/app:1.0"},
+			listsProjects:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, h := newFakeHarbor(t)
+			f.push("team/app", "sha256:a1", pushed, 10, "1.0", "latest")
+			f.push("team/app", "sha256:a2", pushed, 20, "0.9")
+			f.push("team/group/web", "sha256:b1", pushed, 30, "2.0")
+			f.push("other/app", "sha256:c1", pushed, 40, "1.0")
+			// Pages of one item make every listing paginate.
+			h.PageSize = 1
+			h.RepositoryPrefix = tt.repositoryPrefix
+
+			images := []string{}
+			if err := h.WalkImages(func(image string) { images = append(images, image) }); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{}
+			for _, image := range tt.want {
+				want = append(want, h.Prefix()+"/"+image)
+			}
+			if strings.Join(images, ",") != strings.Join(want, ",") {
+				t.Errorf("WalkImages() = %v, want %v", images, want)
+			}
+
+			listsProjects := false
+			for _, request := range f.requests {
+				listsProjects = listsProjects || request == "GET /projects"
+			}
+			if listsProjects != tt.listsProjects {
+				t.Errorf("listed projects = %v, want %v", listsProjects, tt.listsProjects)
+			}
+		})
+	}
+}
+
+func TestHarborHelperImageMeta(t *testing.T) {
+	pushed := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	f, h := newFakeHarbor(t)
+	f.push("team/group/web", "sha256:b1", pushed, 30, "2.0")
+
+	meta, err := h.ImageMeta(h.Prefix() + "/team/group/web:2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Digest != "sha256:b1" || meta.TotalSize != 30 || !meta.Created.Equal(pushed) {
+		t.Errorf("ImageMeta() = %+v", meta)
+	}
+	if _, err := h.ResolveDigest(h.Prefix() + "/team/group/web:missing"); err == nil {
+		t.Errorf("ResolveDigest() of a missing tag, want an error")
+	}
+}
+
+func TestHarborHelperDeleteDigests(t *testing.T) {
+	pushed := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name           string
+		dryRun         bool
+		garbageCollect bool
+		groups         []DigestGroup
+		want           []string
+		wantGC         int
+		wantErr        bool
+	}{
+		{
+			name:   "deletes artifacts",
+			groups: []DigestGroup{{Repository: "team/group/web", Digest: "sha256:b1", Tags: []string{"2.0"}}},
+			want:   []string{"team/group/web@sha256:b1"},
+		},
+		{
+			name:           "triggers garbage collection",
+			garbageCollect: true,
+			groups:         []DigestGroup{{Repository: "team/app", Digest: "sha256:a1", Tags: []string{"1.0"}}},
+			want:           []string{"team/app@sha256:a1"},
+			wantGC:         1,
+		},
+		{
+			name:           "no garbage collection without deletes",
+			dryRun:         true,
+			garbageCollect: true,
+			groups:         []DigestGroup{{Repository: "team/app", Digest: "sha256:a1", Tags: []string{"1.0"}}},
+		},
+		{
+			name:           "missing artifacts are errors",
+			garbageCollect: true,
+			groups: []DigestGroup{
+				{Repository: "team/app", Digest: "sha256:missing", Tags: []string{"0.1"}},
+				{Repository: "team/app", Digest: "sha256:a1", Tags: []string{"1.0"}},
+			},
+			want:    []string{"team/app@sha256:a1"},
+			wantGC:  1,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, h := newFakeHarbor(t)
+			f.push("team/app", "sha256:a1", pushed, 10, "1.0")
+			f.push("team/group/web", "sha256:b1", pushed, 30, "2.0")
+			h.dryRun = tt.dryRun
+			h.GarbageCollect = tt.garbageCollect
+
+			err := h.DeleteDigests(tt.groups)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeleteDigests() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if strings.Join(f.deleted, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("deleted %v, want %v", f.deleted, tt.want)
+			}
+			if f.gcRuns != tt.wantGC {
+				t.Errorf("garbage collections = %d, want %d", f.gcRuns, tt.wantGC)
+			}
+		})
+	}
+}
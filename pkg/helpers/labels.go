@@ -0,0 +1,76 @@
+package helpers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LabelSelector matches image config labels. Unlike Kubernetes selectors,
+// values are taken as they are, so labels holding URLs or paths like
+// org.opencontainers.image.source can be matched.
+type LabelSelector struct {
+	selector     string
+	requirements []labelRequirement
+}
+
+type labelRequirement struct {
+	key   string
+	value string
+	// equals is false for key!=value requirements.
+	equals bool
+	// exists is set for requirements of a bare key.
+	exists bool
+}
+
+// ParseLabelSelector parses comma separated requirements of the form
+// key=value, key!=value or key, all of which must match.
+func ParseLabelSelector(selector string) (*LabelSelector, error) {
+	s := &LabelSelector{selector: selector}
+	for _, requirement := range strings.Split(selector, ",") {
+		requirement = strings.TrimSpace(requirement)
+		if requirement == "" {
+			continue
+		}
+
+		r := labelRequirement{equals: true}
+		key, value, found := strings.Cut(requirement, "=")
+		switch {
+		case !found:
+			r.exists = true
+		case strings.HasSuffix(key, "!"):
+			key = strings.TrimSuffix(key, "!")
+			r.equals = false
+		}
+		r.key = strings.TrimSpace(key)
+		r.value = value
+		if r.key == "" {
+			return nil, fmt.Errorf("invalid label selector %q: %q has no key", selector, requirement)
+		}
+		s.requirements = append(s.requirements, r)
+	}
+	if len(s.requirements) == 0 {
+		return nil, fmt.Errorf("invalid label selector %q: no labels", selector)
+	}
+	return s, nil
+}
+
+// Matches tells whether labels meet every requirement of the selector.
+func (s *LabelSelector) Matches(labels map[string]string) bool {
+	for _, r := range s.requirements {
+		value, ok := labels[r.key]
+		switch {
+		case r.exists && !ok:
+			return false
+		case r.exists:
+		case r.equals && (!ok || value != r.value):
+			return false
+		case !r.equals && ok && value == r.value:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *LabelSelector) String() string {
+	return s.selector
+}
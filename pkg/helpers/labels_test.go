@@ -0,0 +1,65 @@
+package helpers
+
+import "testing"
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{
+		"org.opencontainers.image.source": "https://github.com/stenic/regclean",
+		"team":                            "a",
+		"regclean.keep":                   "true",
+	}
+	tests := []struct {
+		selector string
+		want     bool
+		wantErr  bool
+	}{
+		{selector: "regclean.keep=true", want: true},
+		{selector: "regclean.keep=false", want: false},
+		{selector: "org.opencontainers.image.source=https://github.com/stenic/regclean", want: true},
+		{selector: "org.opencontainers.image.source=https://github.com/stenic/other", want: false},
+		{selector: "team=a, regclean.keep=true", want: true},
+		{selector: "team=a,regclean.keep=false", want: false},
+		{selector: "team!=b", want: true},
+		{selector: "team!=a", want: false},
+		{selector: "missing!=a", want: true},
+		{selector: "team", want: true},
+		{selector: "missing", want: false},
+		{selector: "missing=", want: false},
+		{selector: "=a", wantErr: true},
+		{selector: ",", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			s, err := ParseLabelSelector(tt.selector)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLabelSelector() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := s.Matches(labels); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasLabels(t *testing.T) {
+	tests := []struct {
+		name string
+		reg  Registry
+		want bool
+	}{
+		{name: "v2", reg: &regHelper{}, want: true},
+		{name: "harbor", reg: &harborHelper{}, want: true},
+		{name: "ecr", reg: &ecrHelper{}, want: false},
+		{name: "gitlab", reg: &gitlabHelper{}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HasLabels(tt.reg); got != tt.want {
+				t.Errorf("HasLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
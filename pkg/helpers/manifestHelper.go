@@ -0,0 +1,122 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// manifestHelper finds images in Kubernetes manifests on disk, such as a
+// GitOps repository or the rendered output of kustomize or Helm.
+type manifestHelper struct {
+	dir string
+}
+
+func NewManifestHelper(dir string) *manifestHelper {
+	return &manifestHelper{
+		dir: dir,
+	}
+}
+
+// GetImages walks the YAML and JSON files below the directory and returns the
+// images of every pod spec in them, whatever resource it is part of.
+// Documents that don't parse, like Helm templates, are skipped with a warning,
+// the images of the other documents in the file still count.
+func (h manifestHelper) GetImages() ([]string, error) {
+	images := []string{}
+	err := filepath.WalkDir(h.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != h.dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+
+		fileImages, err := h.fileImages(path)
+		if err != nil {
+			logrus.Warnf("Failed to read %s past %d images: %s", path, len(fileImages), err)
+		}
+		logrus.Tracef("Found %d images in %s", len(fileImages), path)
+		images = append(images, fileImages...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifests in %s: %w", h.dir, err)
+	}
+
+	return cleanImageNames(images), nil
+}
+
+func (h manifestHelper) fileImages(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	images := []string{}
+	decoder := yaml.NewYAMLOrJSONDecoder(f, 4096)
+	for n := 1; ; n++ {
+		var doc interface{}
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return images, nil
+		}
+		// A YAML document that doesn't parse has been read, so the next one
+		// can still be decoded. JSON streams can't be picked up again.
+		var syntaxErr yaml.YAMLSyntaxError
+		if errors.As(err, &syntaxErr) {
+			logrus.Warnf("Failed to parse document %d of %s, skipping: %s", n, path, err)
+			continue
+		}
+		if err != nil {
+			return images, err
+		}
+		images = append(images, findContainerImages(doc)...)
+	}
+}
+
+// findContainerImages looks for container lists anywhere in a decoded
+// document, which covers pod templates of built-in and custom resources and
+// resources wrapped in a List.
+func findContainerImages(doc interface{}) []string {
+	images := []string{}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			switch key {
+			case "containers", "initContainers", "ephemeralContainers":
+				if containers, ok := value.([]interface{}); ok {
+					for _, container := range containers {
+						if c, ok := container.(map[string]interface{}); ok {
+							if image, ok := c["image"].(string); ok && image != "" {
+								images = append(images, image)
+							}
+						}
+					}
+				}
+			}
+			images = append(images, findContainerImages(value)...)
+		}
+	case []interface{}:
+		for _, item := range v {
+			images = append(images, findContainerImages(item)...)
+		}
+	}
+	return images
+}
@@ -0,0 +1,91 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestManifestHelperGetImages(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    []string
+	}{
+		{
+			name: "documents of a YAML stream",
+			file: "app.yaml",
+			content: `apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      initContainers:
+      - image: busybox:1.36
+      containers:
+      - image: registry.test/app:1.0
+---
+apiVersion: batch/v1
+kind: CronJob
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - image: registry.test/job@sha256:abc
+`,
+			want: []string{"busybox:1.36", "registry.test/app:1.0", "registry.test/job@sha256:abc"},
+		},
+		{
+			name: "documents around a broken one",
+			file: "chart.yaml",
+			content: `spec:
+  containers:
+  - image: registry.test/first:1.0
+---
+spec:
+  containers:
+  - image: {{ .Values.image }}
+    name: [broken
+---
+spec:
+  containers:
+  - image: registry.test/last:1.0
+`,
+			want: []string{"registry.test/first:1.0", "registry.test/last:1.0"},
+		},
+		{
+			name:    "JSON stream broken after a document",
+			file:    "list.json",
+			content: `{"spec": {"containers": [{"image": "registry.test/app:1.0"}]}} {"spec": `,
+			want:    []string{"registry.test/app:1.0"},
+		},
+		{
+			name:    "other files are ignored",
+			file:    "notes.txt",
+			content: "image: registry.test/app:1.0",
+			want:    []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, tt.file), []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := NewManifestHelper(dir).GetImages()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("GetImages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
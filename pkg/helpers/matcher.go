@@ -0,0 +1,109 @@
+package helpers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// Matcher matches repository or tag names against a single pattern.
+type Matcher struct {
+	pattern string
+	re      *regexp.Regexp
+	glob    bool
+}
+
+// NewMatcher parses pattern. The "regex:" and "glob:" prefixes pick the syntax
+// explicitly. Without a prefix, patterns anchored with ^ or $ are regular
+// expressions, patterns containing *, ?, [ or { are doublestar globs and
+// anything else matches as a plain substring.
+func NewMatcher(pattern string) (Matcher, error) {
+	switch {
+	case strings.HasPrefix(pattern, "regex:"):
+		return newRegexMatcher(strings.TrimPrefix(pattern, "regex:"))
+	case strings.HasPrefix(pattern, "glob:"):
+		return newGlobMatcher(strings.TrimPrefix(pattern, "glob:"))
+	case strings.HasPrefix(pattern, "^") || strings.HasSuffix(pattern, "$"):
+		return newRegexMatcher(pattern)
+	case strings.ContainsAny(pattern, "*?[{"):
+		return newGlobMatcher(pattern)
+	}
+	return Matcher{pattern: pattern}, nil
+}
+
+// NewSubstringMatcher parses pattern for the name filters, which have always
+// matched plain substrings. Only the "regex:" and "glob:" prefixes pick
+// another syntax, so existing filters containing *, ?, [ or $ keep working.
+func NewSubstringMatcher(pattern string) (Matcher, error) {
+	if strings.HasPrefix(pattern, "regex:") || strings.HasPrefix(pattern, "glob:") {
+		return NewMatcher(pattern)
+	}
+	return Matcher{pattern: pattern}, nil
+}
+
+func newRegexMatcher(pattern string) (Matcher, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Matcher{}, fmt.Errorf("invalid regular expression %q: %w", pattern, err)
+	}
+	return Matcher{pattern: pattern, re: re}, nil
+}
+
+func newGlobMatcher(pattern string) (Matcher, error) {
+	if !doublestar.ValidatePattern(pattern) {
+		return Matcher{}, fmt.Errorf("invalid glob %q", pattern)
+	}
+	return Matcher{pattern: pattern, glob: true}, nil
+}
+
+// NewMatchers parses every non-empty pattern with NewMatcher.
+func NewMatchers(patterns []string) ([]Matcher, error) {
+	return newMatchers(patterns, NewMatcher)
+}
+
+// NewSubstringMatchers parses every non-empty pattern with
+// NewSubstringMatcher.
+func NewSubstringMatchers(patterns []string) ([]Matcher, error) {
+	return newMatchers(patterns, NewSubstringMatcher)
+}
+
+func newMatchers(patterns []string, parse func(pattern string) (Matcher, error)) ([]Matcher, error) {
+	matchers := []Matcher{}
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		m, err := parse(pattern)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+func (m Matcher) Match(s string) bool {
+	switch {
+	case m.re != nil:
+		return m.re.MatchString(s)
+	case m.glob:
+		ok, _ := doublestar.Match(m.pattern, s)
+		return ok
+	}
+	return strings.Contains(s, m.pattern)
+}
+
+func (m Matcher) String() string {
+	return m.pattern
+}
+
+func matchAny(matchers []Matcher, s string) bool {
+	for _, m := range matchers {
+		if m.Match(s) {
+			return true
+		}
+	}
+	return false
+}
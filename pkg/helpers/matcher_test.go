@@ -0,0 +1,51 @@
+package helpers
+
+import "testing"
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		name      string
+		substring bool
+		pattern   string
+		match     []string
+		noMatch   []string
+	}{
+		{name: "substring", pattern: "team", match: []string{"team-a/app", "my-team"}, noMatch: []string{"tea"}},
+		{name: "regex", pattern: "^v?\\d+\\.\\d+$", match: []string{"v1.2", "1.2"}, noMatch: []string{"1.2.3", "latest"}},
+		{name: "glob", pattern: "team-a/**", match: []string{"team-a/app", "team-a/x/app"}, noMatch: []string{"team-b/app"}},
+		{name: "explicit regex", pattern: "regex:app", match: []string{"team/app"}, noMatch: []string{"team/web"}},
+		{name: "explicit glob", pattern: "glob:*/app", match: []string{"team/app"}, noMatch: []string{"team/x/app"}},
+		{name: "name filter with glob characters", substring: true, pattern: "app*", match: []string{"team/app*"}, noMatch: []string{"team/apps"}},
+		{name: "name filter with regex anchors", substring: true, pattern: "^team", match: []string{"x^team"}, noMatch: []string{"team/app"}},
+		{name: "name filter with explicit glob", substring: true, pattern: "glob:team/*", match: []string{"team/app"}, noMatch: []string{"other/app"}},
+		{name: "name filter with explicit regex", substring: true, pattern: "regex:^team/", match: []string{"team/app"}, noMatch: []string{"x/team/app"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parse := NewMatcher
+			if tt.substring {
+				parse = NewSubstringMatcher
+			}
+			m, err := parse(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tt.match {
+				if !m.Match(s) {
+					t.Errorf("%q doesn't match %q", tt.pattern, s)
+				}
+			}
+			for _, s := range tt.noMatch {
+				if m.Match(s) {
+					t.Errorf("%q matches %q", tt.pattern, s)
+				}
+			}
+		})
+	}
+
+	for _, pattern := range []string{"regex:(", "glob:[", "^("} {
+		if _, err := NewMatcher(pattern); err == nil {
+			t.Errorf("NewMatcher(%q) succeeded, want an error", pattern)
+		}
+	}
+}
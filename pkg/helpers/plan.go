@@ -0,0 +1,196 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Plan is the list of digests a run decided to delete, written by
+// "regclean plan" so it can be reviewed before "regclean apply" deletes them.
+type Plan struct {
+	Registry string      `json:"registry"`
+	Created  time.Time   `json:"created"`
+	Entries  []PlanEntry `json:"entries"`
+}
+
+// PlanEntry is a digest to delete along with every tag pointing at it.
+type PlanEntry struct {
+	Repository string    `json:"repository"`
+	Digest     string    `json:"digest"`
+	Tags       []string  `json:"tags"`
+	Children   []string  `json:"children,omitempty"`
+	Size       uint64    `json:"size"`
+	Created    time.Time `json:"created"`
+	Reason     string    `json:"reason"`
+	Rule       string    `json:"rule,omitempty"`
+}
+
+// NewPlanEntry describes group, meta is the metadata of its manifest.
+func NewPlanEntry(group DigestGroup, meta *ImageMeta, reason, rule string) PlanEntry {
+	return PlanEntry{
+		Repository: group.Repository,
+		Digest:     group.Digest,
+		Tags:       group.Tags,
+		Children:   group.Children,
+		Size:       meta.TotalSize,
+		Created:    meta.Created,
+		Reason:     reason,
+		Rule:       rule,
+	}
+}
+
+// Group turns the entry back into a DigestGroup of reg.
+func (e PlanEntry) Group(reg Registry) DigestGroup {
+	group := DigestGroup{
+		Repository: e.Repository,
+		Digest:     e.Digest,
+		Tags:       e.Tags,
+		Children:   e.Children,
+	}
+	for _, tag := range e.Tags {
+		group.Images = append(group.Images, fmt.Sprintf("%s/%s:%s", reg.Prefix(), e.Repository, tag))
+	}
+	return group
+}
+
+// PlanTags are the tags of the repositories of a plan, by the digest they
+// point at when the plan is applied.
+type PlanTags struct {
+	digests map[string][]string // repo@digest
+	// parents holds the tagged indexes referencing a platform manifest.
+	parents map[string][]string // repo@digest
+	// planned holds the digests of the entries still to be deleted.
+	planned map[string]bool  // repo@digest
+	errs    map[string]error // repo
+}
+
+// ResolvePlanTags walks reg for the tags of the repositories in plan and
+// resolves where each of them points now. In repositories where entries
+// delete platform manifests, the indexes tagged now are looked up as well.
+func ResolvePlanTags(reg Registry, plan Plan) (PlanTags, error) {
+	tags := PlanTags{
+		digests: map[string][]string{},
+		parents: map[string][]string{},
+		planned: map[string]bool{},
+		errs:    map[string]error{},
+	}
+	repos := map[string]bool{}
+	withChildren := map[string]bool{}
+	for _, e := range plan.Entries {
+		repos[e.Repository] = true
+		tags.planned[e.Repository+"@"+e.Digest] = true
+		if len(e.Children) > 0 {
+			withChildren[e.Repository] = true
+		}
+	}
+	if len(repos) == 0 {
+		return tags, nil
+	}
+
+	err := reg.WalkImages(func(image string) {
+		repo, tag := splitImageTag(reg, image)
+		if !repos[repo] || tags.errs[repo] != nil {
+			return
+		}
+		dgst, err := reg.ResolveDigest(image)
+		if err != nil {
+			tags.errs[repo] = fmt.Errorf("failed to resolve %s: %w", image, err)
+			return
+		}
+		tags.digests[repo+"@"+dgst] = append(tags.digests[repo+"@"+dgst], tag)
+	})
+	if err != nil {
+		return tags, err
+	}
+
+	for key, tagged := range tags.digests {
+		repo, dgst, _ := strings.Cut(key, "@")
+		if !withChildren[repo] || tags.errs[repo] != nil {
+			continue
+		}
+		meta, err := reg.ImageMeta(fmt.Sprintf("%s/%s:%s", reg.Prefix(), repo, tagged[0]))
+		if err != nil {
+			tags.errs[repo] = fmt.Errorf("failed to get metadata of %s@%s: %w", repo, dgst, err)
+			continue
+		}
+		for _, child := range meta.Children {
+			tags.parents[repo+"@"+child] = append(tags.parents[repo+"@"+child], meta.Digest)
+		}
+	}
+	return tags, nil
+}
+
+// Skip withdraws the entry from the plan, the platform manifests it
+// references are no longer deleted along with it.
+func (t PlanTags) Skip(e PlanEntry) {
+	delete(t.planned, e.Repository+"@"+e.Digest)
+}
+
+// Verify checks that the digest of the entry still has exactly the tags of
+// the entry. Deleting it after a tag moved away, or after another tag was
+// pushed onto it, would delete something nobody reviewed. Its platform
+// manifests must not be tagged or referenced by an index that stays either.
+func (e PlanEntry) Verify(tags PlanTags) error {
+	if err := tags.errs[e.Repository]; err != nil {
+		return err
+	}
+
+	current := map[string]bool{}
+	for _, tag := range tags.digests[e.Repository+"@"+e.Digest] {
+		current[tag] = true
+	}
+	planned := map[string]bool{}
+	for _, tag := range e.Tags {
+		planned[tag] = true
+		if !current[tag] {
+			return fmt.Errorf("%s:%s no longer points at %s", e.Repository, tag, e.Digest)
+		}
+	}
+	for tag := range current {
+		if !planned[tag] {
+			return fmt.Errorf("%s:%s was pushed onto %s after planning", e.Repository, tag, e.Digest)
+		}
+	}
+
+	for _, child := range e.Children {
+		if tagged := tags.digests[e.Repository+"@"+child]; len(tagged) > 0 {
+			return fmt.Errorf("platform manifest %s@%s was tagged %s after planning", e.Repository, child, strings.Join(tagged, ", "))
+		}
+		for _, parent := range tags.parents[e.Repository+"@"+child] {
+			if parent != e.Digest && !tags.planned[e.Repository+"@"+parent] {
+				return fmt.Errorf("platform manifest %s@%s is referenced by %s, which isn't deleted", e.Repository, child, parent)
+			}
+		}
+	}
+	return nil
+}
+
+// WritePlan writes plan to path as JSON, or to stdout when path is "-".
+func WritePlan(path string, plan Plan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// ReadPlan reads a plan written by WritePlan.
+func ReadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("failed to parse plan %s: %w", path, err)
+	}
+	return plan, nil
+}
@@ -0,0 +1,163 @@
+package helpers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlanEntryVerify(t *testing.T) {
+	old := ImageMeta{Digest: "sha256:old"}
+	newer := ImageMeta{Digest: "sha256:new"}
+	entry := PlanEntry{Repository: "app", Digest: "sha256:old", Tags: []string{"1.0", "1.0.1"}}
+
+	tests := []struct {
+		name    string
+		setup   func(reg *fakeRegistry)
+		wantErr string
+	}{
+		{
+			name: "unchanged",
+			setup: func(reg *fakeRegistry) {
+				reg.add("app", "1.0", old)
+				reg.add("app", "1.0.1", old)
+				reg.add("app", "2.0", newer)
+			},
+		},
+		{
+			name: "tag moved away",
+			setup: func(reg *fakeRegistry) {
+				reg.add("app", "1.0", newer)
+				reg.add("app", "1.0.1", old)
+			},
+			wantErr: "app:1.0 no longer points at",
+		},
+		{
+			name: "tag deleted",
+			setup: func(reg *fakeRegistry) {
+				reg.add("app", "1.0.1", old)
+			},
+			wantErr: "app:1.0 no longer points at",
+		},
+		{
+			name: "tag promoted onto the digest",
+			setup: func(reg *fakeRegistry) {
+				reg.add("app", "1.0", old)
+				reg.add("app", "1.0.1", old)
+				reg.add("app", "prod", old)
+			},
+			wantErr: "app:prod was pushed onto",
+		},
+		{
+			name: "same tag in another repository",
+			setup: func(reg *fakeRegistry) {
+				reg.add("app", "1.0", old)
+				reg.add("app", "1.0.1", old)
+				reg.add("other", "prod", old)
+			},
+		},
+		{
+			name: "unresolvable tag in the repository",
+			setup: func(reg *fakeRegistry) {
+				reg.add("app", "1.0", old)
+				reg.add("app", "1.0.1", old)
+				reg.fail("app", "prod")
+			},
+			wantErr: "failed to resolve",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newFakeRegistry()
+			tt.setup(reg)
+			tags, err := ResolvePlanTags(reg, Plan{Entries: []PlanEntry{entry}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = entry.Verify(tags)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Verify() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPlanEntryVerifyChildren(t *testing.T) {
+	index := ImageMeta{Digest: "sha256:index", Children: []string{"sha256:amd64", "sha256:arm64"}}
+	entry := PlanEntry{Repository: "app", Digest: "sha256:index", Tags: []string{"1.0"}, Children: index.Children}
+
+	tests := []struct {
+		name  string
+		setup func(reg *fakeRegistry)
+		// others are planned along with entry, skipped are withdrawn again.
+		others  []PlanEntry
+		skipped []PlanEntry
+		wantErr string
+	}{
+		{
+			name: "unchanged",
+			setup: func(reg *fakeRegistry) {
+				reg.add("app", "1.0", index)
+				reg.add("app", "2.0", ImageMeta{Digest: "sha256:new", Children: []string{"sha256:riscv"}})
+			},
+		},
+		{
+			name: "index pushed onto a platform manifest",
+			setup: func(reg *fakeRegistry) {
+				reg.add("app", "1.0", index)
+				reg.add("app", "2.0", ImageMeta{Digest: "sha256:new", Children: []string{"sha256:arm64", "sha256:riscv"}})
+			},
+			wantErr: "platform manifest app@sha256:arm64 is referenced by sha256:new",
+		},
+		{
+			name: "platform manifest tagged",
+			setup: func(reg *fakeRegistry) {
+				reg.add("app", "1.0", index)
+				reg.add("app", "1.0-amd64", ImageMeta{Digest: "sha256:amd64"})
+			},
+			wantErr: "platform manifest app@sha256:amd64 was tagged 1.0-amd64",
+		},
+		{
+			name: "index sharing it is deleted too",
+			setup: func(reg *fakeRegistry) {
+				reg.add("app", "1.0", index)
+				reg.add("app", "1.1", ImageMeta{Digest: "sha256:other", Children: []string{"sha256:amd64"}})
+			},
+			others: []PlanEntry{{Repository: "app", Digest: "sha256:other", Tags: []string{"1.1"}}},
+		},
+		{
+			name: "index sharing it is skipped",
+			setup: func(reg *fakeRegistry) {
+				reg.add("app", "1.0", index)
+				reg.add("app", "1.1", ImageMeta{Digest: "sha256:other", Children: []string{"sha256:amd64"}})
+			},
+			others:  []PlanEntry{{Repository: "app", Digest: "sha256:other", Tags: []string{"1.1"}}},
+			skipped: []PlanEntry{{Repository: "app", Digest: "sha256:other", Tags: []string{"1.1"}}},
+			wantErr: "platform manifest app@sha256:amd64 is referenced by sha256:other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newFakeRegistry()
+			tt.setup(reg)
+			tags, err := ResolvePlanTags(reg, Plan{Entries: append([]PlanEntry{entry}, tt.others...)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range tt.skipped {
+				tags.Skip(e)
+			}
+
+			err = entry.Verify(tags)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Verify() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Verify() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
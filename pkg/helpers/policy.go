@@ -0,0 +1,117 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	PolicyActionDelete = "delete"
+	PolicyActionKeep   = "keep"
+)
+
+// Policy is an ordered list of rules, the first rule matching an image decides
+// how it is cleaned. Images no rule matches fall back to the global flags.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule matches images by repository and tag. Without patterns a rule
+// matches every image, which makes it useful as a catch-all at the end.
+type PolicyRule struct {
+	Name         string   `json:"name"`
+	Repositories []string `json:"repositories"`
+	Tags         []string `json:"tags"`
+	// Action is either "delete", the default, or "keep" to never delete.
+	Action string `json:"action"`
+	// MinAge and KeepLast override the global flags when set.
+	MinAge   *int `json:"minAge"`
+	KeepLast *int `json:"keepLast"`
+	// ProtectedTags are never deleted, even when the rule deletes.
+	ProtectedTags []string `json:"protectedTags"`
+
+	repositories []Matcher
+	tags         []Matcher
+	protected    []Matcher
+}
+
+// LoadPolicy reads and validates the policy file at path.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy %s: %w", path, err)
+	}
+	if err := policy.compile(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	return policy, nil
+}
+
+func (p *Policy) compile() error {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule #%d", i+1)
+		}
+		switch rule.Action {
+		case "":
+			rule.Action = PolicyActionDelete
+		case PolicyActionDelete, PolicyActionKeep:
+		default:
+			return fmt.Errorf("%s: unknown action %q, expected %s or %s", rule.Name, rule.Action, PolicyActionDelete, PolicyActionKeep)
+		}
+
+		var err error
+		if rule.repositories, err = NewMatchers(rule.Repositories); err != nil {
+			return fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		if rule.tags, err = NewMatchers(rule.Tags); err != nil {
+			return fmt.Errorf("%s: %w", rule.Name, err)
+		}
+		if rule.protected, err = NewMatchers(rule.ProtectedTags); err != nil {
+			return fmt.Errorf("%s: %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// Match returns the first rule matching the repository and tag, or nil.
+func (p *Policy) Match(repository, tag string) *PolicyRule {
+	if p == nil {
+		return nil
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if len(rule.repositories) > 0 && !matchAny(rule.repositories, repository) {
+			continue
+		}
+		if len(rule.tags) > 0 && !matchAny(rule.tags, tag) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+func (p *Policy) setsKeepLast() bool {
+	if p == nil {
+		return false
+	}
+	for _, rule := range p.Rules {
+		if rule.KeepLast != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Protects reports whether tag is one of the protected tags of the rule.
+func (r PolicyRule) Protects(tag string) bool {
+	return matchAny(r.protected, tag)
+}
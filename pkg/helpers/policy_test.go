@@ -0,0 +1,131 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePolicy(t *testing.T, policy string) string {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			policy: `rules:
+- name: releases
+  tags: ["^v?[0-9.]+$"]
+  action: keep
+- repositories: ["ci/**"]
+  minAge: 3
+  keepLast: 5
+  protectedTags: [main]
+`,
+		},
+		{name: "unknown key", policy: "rules:\n- name: typo\n  min_age: 3\n", wantErr: true},
+		{name: "unknown action", policy: "rules:\n- action: purge\n", wantErr: true},
+		{name: "invalid pattern", policy: "rules:\n- tags: [\"regex:(\"]\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := LoadPolicy(writePolicy(t, tt.policy))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			rule := policy.Rules[1]
+			if rule.Name != "rule #2" || rule.Action != PolicyActionDelete || *rule.MinAge != 3 || *rule.KeepLast != 5 {
+				t.Errorf("second rule = %+v", rule)
+			}
+		})
+	}
+}
+
+func TestPolicyMatch(t *testing.T) {
+	policy, err := LoadPolicy(writePolicy(t, `rules:
+- name: releases
+  tags: ["^v[0-9.]+$"]
+  action: keep
+- name: ci
+  repositories: ["ci/**"]
+- name: everything
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		repository string
+		tag        string
+		want       string
+	}{
+		{repository: "ci/app", tag: "v1.0", want: "releases"},
+		{repository: "ci/app", tag: "pr-1", want: "ci"},
+		{repository: "app", tag: "pr-1", want: "everything"},
+	}
+	for _, tt := range tests {
+		if rule := policy.Match(tt.repository, tt.tag); rule == nil || rule.Name != tt.want {
+			t.Errorf("Match(%s, %s) = %v, want %s", tt.repository, tt.tag, rule, tt.want)
+		}
+	}
+	if rule := (*Policy)(nil).Match("app", "1.0"); rule != nil {
+		t.Errorf("Match() without a policy = %v, want nil", rule)
+	}
+}
+
+func TestFilterImagePolicy(t *testing.T) {
+	policy, err := LoadPolicy(writePolicy(t, `rules:
+- name: releases
+  tags: ["^v[0-9.]+$"]
+  action: keep
+- name: ci
+  repositories: ["ci/**"]
+  minAge: 1
+  protectedTags: [main]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	week := time.Now().AddDate(0, 0, -7)
+	tests := []struct {
+		name       string
+		repository string
+		tag        string
+		wantDelete bool
+		wantReason string
+		wantRule   string
+	}{
+		{name: "keep action", repository: "ci/app", tag: "v1.0", wantReason: "policy_keep", wantRule: "releases"},
+		{name: "protected tag", repository: "ci/app", tag: "main", wantReason: "protected", wantRule: "ci"},
+		{name: "minimum age of the rule", repository: "ci/app", tag: "pr-1", wantDelete: true, wantReason: "delete", wantRule: "ci"},
+		{name: "global minimum age", repository: "app", tag: "pr-1", wantReason: "min_age"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newFakeRegistry()
+			image := reg.add(tt.repository, tt.tag, ImageMeta{Created: week})
+			h := NewFilterHelper(reg)
+			h.MinAge = 30
+			h.Policy = policy
+
+			if got := h.FilterImage(image); got != tt.wantDelete {
+				t.Errorf("FilterImage() = %v, want %v", got, tt.wantDelete)
+			}
+			if d, _ := h.Decision(image); d.Reason != tt.wantReason || d.Rule != tt.wantRule {
+				t.Errorf("Decision() = %+v, want %s by %q", d, tt.wantReason, tt.wantRule)
+			}
+		})
+	}
+}
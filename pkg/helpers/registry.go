@@ -0,0 +1,566 @@
+package helpers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Registry is a container registry regclean can list and clean. Backends
+// for vendor APIs implement it and register a RegistryFactory, the filter
+// logic only ever talks to this interface.
+type Registry interface {
+	// Prefix returns the registry host images are referenced by.
+	Prefix() string
+	// WalkImages calls fn for every image in the registry, listing the
+	// images of a repository one after the other.
+	WalkImages(fn func(image string)) error
+	// ImageMeta returns the metadata of image, possibly from a cache. The
+	// digest must be resolved during the run, tags move between runs.
+	ImageMeta(image string) (*ImageMeta, error)
+	// ResolveDigest asks the registry which manifest image points at now.
+	ResolveDigest(image string) (string, error)
+	// DeleteDigests deletes the manifests of groups, taking all their tags
+	// and platform manifests along.
+	DeleteDigests(groups []DigestGroup) error
+}
+
+// labelRegistry is implemented by backends whose ImageMeta fills in the
+// config labels of images.
+type labelRegistry interface {
+	HasLabels() bool
+}
+
+// HasLabels tells whether the metadata of reg holds the config labels of
+// images. Backends that don't fetch the image config leave them empty.
+func HasLabels(reg Registry) bool {
+	r, ok := reg.(labelRegistry)
+	return ok && r.HasLabels()
+}
+
+// RegistryOptions holds the settings shared by all registry backends.
+type RegistryOptions struct {
+	URL      string
+	Username string
+	Password string
+	Token    string
+	// Endpoint overrides the API endpoint for backends with a separate API.
+	Endpoint         string
+	DryRun           bool
+	PageSize         int
+	RepositoryPrefix string
+	// GarbageCollect asks backends that support it to run a registry GC
+	// after deleting.
+	GarbageCollect bool
+}
+
+// RegistryFactory creates a registry backend.
+type RegistryFactory func(opts RegistryOptions) (Registry, error)
+
+var registryTypes = map[string]RegistryFactory{
+	"v2": func(opts RegistryOptions) (Registry, error) {
+		h, err := NewRegHelper(opts.URL, opts.Username, opts.Password, opts.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		h.PageSize = opts.PageSize
+		h.RepositoryPrefix = opts.RepositoryPrefix
+		return h, nil
+	},
+	"ecr": func(opts RegistryOptions) (Registry, error) {
+		h, err := NewECRHelper(opts.URL, opts.Endpoint, opts.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		h.PageSize = opts.PageSize
+		h.RepositoryPrefix = opts.RepositoryPrefix
+		return h, nil
+	},
+	"harbor": func(opts RegistryOptions) (Registry, error) {
+		h, err := NewHarborHelper(opts.URL, opts.Username, opts.Password, opts.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		h.PageSize = opts.PageSize
+		h.RepositoryPrefix = opts.RepositoryPrefix
+		h.GarbageCollect = opts.GarbageCollect
+		return h, nil
+	},
+	"gitlab": func(opts RegistryOptions) (Registry, error) {
+		h, err := NewGitlabHelper(opts.URL, opts.Token, opts.DryRun)
+		if err != nil {
+			return nil, err
+		}
+		h.PageSize = opts.PageSize
+		h.RepositoryPrefix = opts.RepositoryPrefix
+		return h, nil
+	},
+}
+
+// RegisterRegistryType makes a backend available under name.
+func RegisterRegistryType(name string, factory RegistryFactory) {
+	registryTypes[name] = factory
+}
+
+// RegistryTypes lists the names of the available backends.
+func RegistryTypes() []string {
+	names := []string{}
+	for name := range registryTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewRegistry creates the backend registered as registryType. Without a type
+// the backend is taken from the URL scheme, so "ecr://<host>" selects the ECR
+// backend, and plain http(s) URLs use the registry v2 API.
+func NewRegistry(registryType string, opts RegistryOptions) (Registry, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+		if registryType == "" {
+			registryType = u.Scheme
+		}
+		u.Scheme = "https"
+		opts.URL = u.String()
+	}
+	if registryType == "" {
+		registryType = "v2"
+	}
+
+	factory, ok := registryTypes[registryType]
+	if !ok {
+		return nil, fmt.Errorf("unknown registry type %q, expected one of %s", registryType, strings.Join(RegistryTypes(), ", "))
+	}
+	logrus.Debugf("Using %s registry backend", registryType)
+	return factory(opts)
+}
+
+// ImageMeta is what regclean needs to know about an image to decide on it.
+type ImageMeta struct {
+	Created   time.Time
+	TotalSize uint64
+	Digest    string
+	// Children holds the platform manifests of a manifest list or OCI index.
+	Children []string
+	// LastPulled is only known to registries that record pulls.
+	LastPulled time.Time
+	// Labels holds the labels of the image config, when the backend reads it.
+	Labels map[string]string
+	// Blobs holds the size of every config and layer blob by digest, when the
+	// backend reads the manifests.
+	Blobs map[string]uint64
+}
+
+// RunningDigest returns the digest of meta that is in digests, the index
+// itself or one of its platform manifests, since runtimes may report either.
+func (meta ImageMeta) RunningDigest(digests map[string]bool) (string, bool) {
+	if digests[meta.Digest] {
+		return meta.Digest, true
+	}
+	for _, child := range meta.Children {
+		if digests[child] {
+			return child, true
+		}
+	}
+	return "", false
+}
+
+// blobs returns meta.Blobs, or the manifest as a single blob of the total
+// size when the backend doesn't know the blobs.
+func (meta ImageMeta) blobs() map[string]uint64 {
+	if len(meta.Blobs) > 0 {
+		return meta.Blobs
+	}
+	return map[string]uint64{meta.Digest: meta.TotalSize}
+}
+
+func splitImageTag(reg Registry, image string) (string, string) {
+	i := strings.Split(strings.TrimPrefix(image, reg.Prefix()+"/"), ":")
+	return i[0], i[1]
+}
+
+// DigestGroup is a manifest in a repository together with every tag that
+// points at it. Deleting the manifest removes all of those tags at once.
+type DigestGroup struct {
+	Repository string
+	Digest     string
+	Tags       []string
+	Images     []string
+	// Children holds the platform manifests of an index that are deleted
+	// along with it.
+	Children []string
+	// Unknown is set for an image whose metadata couldn't be fetched. Its
+	// digest and children are unknown, so it is never deleted and may
+	// reference any manifest of its repository.
+	Unknown bool
+}
+
+// GroupByDigest groups images by the manifest they resolve to. Images whose
+// metadata can't be fetched get an Unknown group of their own.
+func GroupByDigest(reg Registry, images []string) []DigestGroup {
+	groups := []DigestGroup{}
+	index := map[string]int{}
+	for _, image := range images {
+		img, tag := splitImageTag(reg, image)
+		meta, err := reg.ImageMeta(image)
+		if err != nil {
+			logrus.Tracef("Failed to get image digest for %s, keeping it", image)
+			groups = append(groups, DigestGroup{
+				Repository: img,
+				Tags:       []string{tag},
+				Images:     []string{image},
+				Unknown:    true,
+			})
+			continue
+		}
+		key := img + "@" + meta.Digest
+		if i, ok := index[key]; ok {
+			groups[i].Tags = append(groups[i].Tags, tag)
+			groups[i].Images = append(groups[i].Images, image)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, DigestGroup{
+			Repository: img,
+			Digest:     meta.Digest,
+			Tags:       []string{tag},
+			Images:     []string{image},
+			Children:   meta.Children,
+		})
+	}
+	return groups
+}
+
+// PruneSharedChildren moves the groups being deleted that a kept group still
+// references to the kept groups, and drops the platform manifests that are
+// still referenced from the groups being deleted. A manifest is referenced
+// when it is tagged by a kept group or a child of a kept index. Nothing is
+// deleted from a repository with Unknown groups, as they may reference any
+// manifest. A child shared by several deleted indexes, or deleted as a group
+// of its own, is only deleted once.
+func PruneSharedChildren(toDelete, toKeep []DigestGroup) ([]DigestGroup, []DigestGroup) {
+	referenced := map[string]bool{}
+	unknownRepos := map[string]bool{}
+	for _, group := range toKeep {
+		if group.Unknown {
+			unknownRepos[group.Repository] = true
+			continue
+		}
+		referenced[group.Repository+"@"+group.Digest] = true
+		for _, child := range group.Children {
+			referenced[group.Repository+"@"+child] = true
+		}
+	}
+
+	deleted := []DigestGroup{}
+	kept := append([]DigestGroup{}, toKeep...)
+	for _, group := range toDelete {
+		key := group.Repository + "@" + group.Digest
+		switch {
+		case unknownRepos[group.Repository]:
+			logrus.Debugf("Repository %s has images without metadata, keeping %s", group.Repository, key)
+			kept = append(kept, group)
+		case referenced[key]:
+			logrus.Tracef("Manifest %s is a platform of a kept index, skipping", key)
+			kept = append(kept, group)
+		default:
+			deleted = append(deleted, group)
+		}
+	}
+
+	// Children deleted as a group of their own aren't deleted again.
+	for _, group := range deleted {
+		referenced[group.Repository+"@"+group.Digest] = true
+	}
+	pruned := []DigestGroup{}
+	for _, group := range deleted {
+		children := []string{}
+		for _, child := range group.Children {
+			key := group.Repository + "@" + child
+			if referenced[key] {
+				logrus.Tracef("Platform manifest %s is still referenced, skipping", key)
+				continue
+			}
+			referenced[key] = true
+			children = append(children, child)
+		}
+		group.Children = children
+		pruned = append(pruned, group)
+	}
+	return pruned, kept
+}
+
+// SpaceUsage is the space taken by manifests that are deleted.
+type SpaceUsage struct {
+	// Logical sums the sizes of the manifests, counting a blob for every
+	// manifest that references it.
+	Logical uint64
+	// Reclaimable only counts the blobs no kept manifest references, once.
+	// Only the tagged manifests of the walked repositories are seen as kept,
+	// so it is an upper bound.
+	Reclaimable uint64
+	// Approximate is set when the backend doesn't know the blobs of some
+	// deleted manifests, their whole size counts as reclaimable then.
+	Approximate bool
+}
+
+// SpaceCounter adds up the space taken by manifests that are deleted, one
+// repository at a time. A blob is reclaimable when no kept group references
+// it, in any repository, as registries store blobs once. Only blob digests
+// are held, never the metadata of the images.
+type SpaceCounter struct {
+	kept    map[string]bool
+	deleted map[string]uint64
+	// repos holds the repositories deleting a blob, as "repo@blob".
+	repos   map[string]bool
+	logical map[string]uint64
+	// approximate holds the repositories deleting manifests of unknown
+	// blobs.
+	approximate map[string]bool
+}
+
+func NewSpaceCounter() *SpaceCounter {
+	return &SpaceCounter{
+		kept:        map[string]bool{},
+		deleted:     map[string]uint64{},
+		repos:       map[string]bool{},
+		logical:     map[string]uint64{},
+		approximate: map[string]bool{},
+	}
+}
+
+// Add counts the blobs of toDelete and remembers the blobs toKeep references.
+func (c *SpaceCounter) Add(reg Registry, toDelete, toKeep []DigestGroup) {
+	for _, group := range toKeep {
+		if group.Unknown {
+			continue
+		}
+		meta, err := reg.ImageMeta(group.Images[0])
+		if err != nil {
+			continue
+		}
+		for blob := range meta.blobs() {
+			c.kept[blob] = true
+		}
+	}
+	for _, group := range toDelete {
+		meta, err := reg.ImageMeta(group.Images[0])
+		if err != nil {
+			continue
+		}
+		c.logical[group.Repository] += meta.TotalSize
+		if len(meta.Blobs) == 0 {
+			c.approximate[group.Repository] = true
+		}
+		for blob, size := range meta.blobs() {
+			c.deleted[blob] = size
+			c.repos[group.Repository+"@"+blob] = true
+		}
+	}
+}
+
+// Space returns the space of the deleted manifests in total and by
+// repository. A blob shared by deleted manifests of several repositories
+// counts for each of them, so the repository numbers can add up to more than
+// the total.
+func (c *SpaceCounter) Space() (SpaceUsage, map[string]SpaceUsage) {
+	total := SpaceUsage{}
+	byRepo := map[string]SpaceUsage{}
+	for repo, logical := range c.logical {
+		total.Logical += logical
+		total.Approximate = total.Approximate || c.approximate[repo]
+		byRepo[repo] = SpaceUsage{Logical: logical, Approximate: c.approximate[repo]}
+	}
+	for key := range c.repos {
+		repo, blob, _ := strings.Cut(key, "@")
+		if c.kept[blob] {
+			continue
+		}
+		usage := byRepo[repo]
+		usage.Reclaimable += c.deleted[blob]
+		byRepo[repo] = usage
+	}
+	for blob, size := range c.deleted {
+		if !c.kept[blob] {
+			total.Reclaimable += size
+		}
+	}
+	return total, byRepo
+}
+
+// WalkRepositories walks the images of reg and calls fn with the images of
+// one repository at a time, once a pool of concurrency workers fetched their
+// metadata. Only the repositories being fetched are held in memory, so
+// backends have to list the images of a repository one after the other.
+func WalkRepositories(reg Registry, concurrency int, fn func(repo string, images []string) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	type batch struct {
+		repo    string
+		images  []string
+		fetched *sync.WaitGroup
+	}
+	type job struct {
+		image   string
+		fetched *sync.WaitGroup
+	}
+
+	// stop tells the walk and the workers fn failed, so nothing is waiting
+	// for their results anymore.
+	stop := make(chan struct{})
+	batches := make(chan batch)
+	var walkErr error
+	go func() {
+		defer close(batches)
+		seen := map[string]bool{}
+		current := batch{}
+		send := func() bool {
+			if len(current.images) == 0 {
+				return true
+			}
+			select {
+			case batches <- current:
+				return true
+			case <-stop:
+				return false
+			}
+		}
+		err := reg.WalkImages(func(image string) {
+			if walkErr != nil {
+				return
+			}
+			repo, _ := splitImageTag(reg, image)
+			if repo != current.repo {
+				if seen[repo] {
+					walkErr = fmt.Errorf("repository %s was listed twice, its images can't be decided on", repo)
+					return
+				}
+				seen[repo] = true
+				if !send() {
+					walkErr = errStopped
+					return
+				}
+				current = batch{repo: repo}
+			}
+			current.images = append(current.images, image)
+		})
+		if walkErr == nil && err == nil && !send() {
+			walkErr = errStopped
+		}
+		if walkErr == nil {
+			walkErr = err
+		}
+	}()
+
+	var fetched atomic.Int64
+	jobs := make(chan job)
+	pending := make(chan batch, concurrency)
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for {
+			var b batch
+			select {
+			case next, ok := <-batches:
+				if !ok {
+					return
+				}
+				b = next
+			case <-stop:
+				return
+			}
+			b.fetched = &sync.WaitGroup{}
+			b.fetched.Add(len(b.images))
+			select {
+			case pending <- b:
+			case <-stop:
+				return
+			}
+			for _, image := range b.images {
+				select {
+				case jobs <- job{image, b.fetched}:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for j := range jobs {
+				// Errors are logged by the registry and surface again when
+				// the metadata is used.
+				_, _ = reg.ImageMeta(j.image)
+				fetched.Add(1)
+				j.fetched.Done()
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for b := range pending {
+		done := make(chan struct{})
+		go func() {
+			b.fetched.Wait()
+			close(done)
+		}()
+	wait:
+		for {
+			select {
+			case <-ticker.C:
+				logrus.Infof("Fetched metadata for %d images", fetched.Load())
+			case <-done:
+				break wait
+			}
+		}
+		if err := fn(b.repo, b.images); err != nil {
+			close(stop)
+			return err
+		}
+	}
+	logrus.Debugf("Fetched metadata for %d images", fetched.Load())
+	return walkErr
+}
+
+var errStopped = errors.New("walk stopped")
+
+// doJSON sends req for the API based backends and decodes the JSON response
+// into response when it is set.
+func doJSON(client *http.Client, req *http.Request, response interface{}) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return resp, fmt.Errorf("%s %s: unexpected status %d: %s", req.Method, req.URL, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if response != nil && len(body) > 0 {
+		if err := json.Unmarshal(body, response); err != nil {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
@@ -3,29 +3,46 @@ package helpers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"github.com/stenic/regclean/pkg/caching"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/eko/gocache/lib/v4/cache"
 	"github.com/sirupsen/logrus"
+	"github.com/stenic/regclean/pkg/caching"
 
 	"github.com/heroku/docker-registry-client/registry"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/singleflight"
 )
 
+const defaultPageSize = 100
+
 type regHelper struct {
 	hub          *registry.Registry
 	RegPrefix    string
 	dryRun       bool
-	cache        map[string]imageMeta
-	cacheManager *cache.Cache[imageMeta]
+	cache        map[string]ImageMeta
+	cacheManager *cache.Cache[ImageMeta]
+	inflight     *singleflight.Group
+	// digests holds the digest every tag resolved to during this run. Tags
+	// move, so only metadata by digest is kept across runs.
+	digests *sync.Map
+
+	// PageSize is the number of entries requested per catalog or tag page.
+	PageSize int
+	// RepositoryPrefix limits listing to repositories starting with it.
+	RepositoryPrefix string
 }
 
-func NewRegHelper(URL, username, password string, dryRun bool) *regHelper {
+func NewRegHelper(URL, username, password string, dryRun bool) (*regHelper, error) {
 	URL = strings.TrimSuffix(URL, "/")
 	hub := &registry.Registry{
 		URL: URL,
@@ -43,144 +60,441 @@ func NewRegHelper(URL, username, password string, dryRun bool) *regHelper {
 	}
 
 	if err := hub.Ping(); err != nil {
-		logrus.Fatal(err)
+		return nil, fmt.Errorf("failed to reach registry %s: %w", URL, err)
 	}
 
 	u, err := url.ParseRequestURI(URL)
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, err
 	}
 	regPrefix := u.Host
 
+	cacheManager, err := caching.NewCache[ImageMeta]()
+	if err != nil {
+		return nil, err
+	}
+
 	return &regHelper{
 		hub:          hub,
 		RegPrefix:    regPrefix,
-		cache:        map[string]imageMeta{},
-		cacheManager: caching.NewCache[imageMeta](),
+		cache:        map[string]ImageMeta{},
+		cacheManager: cacheManager,
+		inflight:     &singleflight.Group{},
+		digests:      &sync.Map{},
 		dryRun:       dryRun,
+		PageSize:     defaultPageSize,
+	}, nil
+}
+
+type catalogResponse struct {
+	Repositories []string `json:"repositories"`
+}
+
+type tagsResponse struct {
+	Tags []string `json:"tags"`
+}
+
+// Matches the URL in an RFC 5988 Link header with rel="next".
+var nextLinkRE = regexp.MustCompile(`^ *<?([^;>]+)>? *(?:;[^;]*)*; *rel="?next"?(?:;.*)?`)
+
+// WalkImages pages through the catalog and the tag list of every repository
+// under RepositoryPrefix and calls fn for each image as soon as its page is
+// fetched, so the full catalog is never held in memory.
+func (h regHelper) WalkImages(fn func(image string)) error {
+	last := ""
+	if h.RepositoryPrefix != "" {
+		// The catalog is returned in lexical order, so listing can start
+		// right before the prefix and stop once it is passed.
+		last = h.RepositoryPrefix[:len(h.RepositoryPrefix)-1]
 	}
+
+	done := false
+	return h.paginate("/v2/_catalog", last, func(body []byte) ([]string, bool, error) {
+		var catalog catalogResponse
+		if err := json.Unmarshal(body, &catalog); err != nil {
+			return nil, false, err
+		}
+		for _, repo := range catalog.Repositories {
+			if !strings.HasPrefix(repo, h.RepositoryPrefix) {
+				if repo > h.RepositoryPrefix {
+					done = true
+					break
+				}
+				continue
+			}
+			if err := h.walkTags(repo, fn); err != nil {
+				return nil, false, err
+			}
+		}
+		return catalog.Repositories, done, nil
+	})
 }
 
-func (h regHelper) GetImages() []string {
-	repos, err := h.hub.Repositories()
-	if err != nil {
-		logrus.Fatal(err)
+func (h regHelper) walkTags(repo string, fn func(image string)) error {
+	return h.paginate("/v2/"+repo+"/tags/list", "", func(body []byte) ([]string, bool, error) {
+		var tags tagsResponse
+		if err := json.Unmarshal(body, &tags); err != nil {
+			return nil, false, err
+		}
+		for _, tag := range tags.Tags {
+			fn(fmt.Sprintf("%s/%s:%s", h.RegPrefix, repo, tag))
+		}
+		return tags.Tags, false, nil
+	})
+}
+
+// paginate requests path page by page using the n/last parameters and hands
+// every page to handle, which returns the entries on the page and whether to
+// stop. The Link header is followed when present. Without one, a short page
+// doesn't mean the list ended, registries may cap the page size below n, so
+// listing continues from the last entry until a page comes back empty. A
+// rejected page size is halved until it is accepted.
+func (h regHelper) paginate(path, last string, handle func(body []byte) ([]string, bool, error)) error {
+	pageSize := h.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
 	}
 
-	images := []string{}
-	for _, repo := range repos {
-		tags, err := h.hub.Tags(repo)
+	next := ""
+	for {
+		pageURL := next
+		if pageURL == "" {
+			query := url.Values{}
+			query.Set("n", strconv.Itoa(pageSize))
+			if last != "" {
+				query.Set("last", last)
+			}
+			pageURL = h.hub.URL + path + "?" + query.Encode()
+		}
+		logrus.Tracef("registry.page.get url=%s", pageURL)
+
+		resp, err := h.hub.Client.Get(pageURL)
 		if err != nil {
-			logrus.Fatal(err)
+			var statusErr *registry.HTTPStatusError
+			if errors.As(err, &statusErr) && strings.Contains(string(statusErr.Body), "PAGINATION_NUMBER_INVALID") && pageSize > 1 {
+				pageSize /= 2
+				next = ""
+				logrus.Debugf("Registry rejected the page size, retrying with %d", pageSize)
+				continue
+			}
+			return err
 		}
-		for _, tag := range tags {
-			images = append(images, fmt.Sprintf("%s/%s:%s", h.RegPrefix, repo, tag))
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
 		}
-	}
 
-	return images
+		entries, done, err := handle(body)
+		if err != nil {
+			return err
+		}
+		if done || len(entries) == 0 {
+			return nil
+		}
+		if entries[len(entries)-1] == last {
+			// Continuing would request the same page forever.
+			return fmt.Errorf("registry ignored last=%s when paging %s", last, path)
+		}
+		last = entries[len(entries)-1]
+
+		next = ""
+		for _, link := range resp.Header.Values("Link") {
+			if parts := nextLinkRE.FindStringSubmatch(link); parts != nil {
+				ref, err := url.Parse(parts[1])
+				if err != nil {
+					return err
+				}
+				base, _ := url.Parse(h.hub.URL)
+				next = base.ResolveReference(ref).String()
+				break
+			}
+		}
+	}
 }
 
-func (h regHelper) splitImageTag(image string) (string, string) {
-	i := strings.Split(strings.TrimPrefix(image, h.RegPrefix+"/"), ":")
-	return i[0], i[1]
+// DeleteDigests deletes the manifest of every group, carrying on after a
+// failure so one bad manifest doesn't stop the run.
+func (h regHelper) DeleteDigests(groups []DigestGroup) error {
+	errs := []error{}
+	for _, group := range groups {
+		if err := h.deleteDigest(group); err != nil {
+			errs = append(errs, fmt.Errorf("%s@%s: %w", group.Repository, group.Digest, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func (h regHelper) DeleteImage(image string) error {
-	img, tag := h.splitImageTag(image)
-	digest, err := h.hub.ManifestDigest(img, tag)
+func (h regHelper) deleteDigest(group DigestGroup) error {
+	logFields := logrus.Fields{
+		"tags": group.Tags,
+	}
+	dgst, err := digest.Parse(group.Digest)
 	if err != nil {
-		return fmt.Errorf("failed to fetch digest: %w", err)
+		return fmt.Errorf("invalid digest: %w", err)
+	}
+
+	if len(group.Children) > 0 {
+		logFields["platforms"] = group.Children
+	}
+
+	// Tags may have been pushed again since they were resolved, deleting the
+	// digest would then delete an image nobody decided on.
+	for _, image := range group.Images {
+		current, err := h.ResolveDigest(image)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", image, err)
+		}
+		if current != group.Digest {
+			return fmt.Errorf("%s moved to %s, not deleting", image, current)
+		}
 	}
 
 	if h.dryRun {
-		logrus.Infof("Dry run, skipping delete of %s:%s (%s) on registry", img, tag, digest.String())
+		logrus.WithFields(logFields).Infof("Dry run, skipping delete of %s@%s on registry", group.Repository, group.Digest)
 		return nil
 	}
 
-	logrus.Warnf("Deleting %s:%s (%s) on registry", img, tag, digest.String())
-	if err = h.hub.DeleteManifest(img, digest); err != nil {
+	logrus.WithFields(logFields).Warnf("Deleting %s@%s on registry", group.Repository, group.Digest)
+	if err = h.hub.DeleteManifest(group.Repository, dgst); err != nil {
 		return fmt.Errorf("failed to delete manifest: %w", err)
 	}
+
+	// The index goes first, registries may refuse to delete a manifest that
+	// an index still points at.
+	for _, child := range group.Children {
+		logrus.WithFields(logFields).Debugf("Deleting platform manifest %s@%s on registry", group.Repository, child)
+		if err = h.hub.DeleteManifest(group.Repository, digest.Digest(child)); err != nil {
+			return fmt.Errorf("failed to delete platform manifest %s: %w", child, err)
+		}
+	}
 	return nil
 }
 
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
 type blobResponse struct {
 	Created time.Time `json:"created"`
+	Config  struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
 }
 
-type imageMeta struct {
-	Created   time.Time
-	TotalSize uint64
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
 }
 
-func (h regHelper) imageMeta(img, tag string) (*imageMeta, error) {
-    logFields := logrus.Fields{
-        "image": img + ":" + tag,
-    }
-	key := img + ":" + tag
-	if meta, err := h.cacheManager.Get(context.TODO(), key); err == nil {
-		return &meta, nil
+// manifestResponse covers both image manifests and manifest lists / OCI
+// indexes; only the fields relevant to the media type are filled in.
+type manifestResponse struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+func (m manifestResponse) isIndex() bool {
+	return m.MediaType == mediaTypeDockerManifestList || m.MediaType == mediaTypeOCIIndex
+}
+
+func (h regHelper) getManifest(img, ref string) (*manifestResponse, string, error) {
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", h.hub.URL, img, ref)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", err
 	}
+	req.Header.Set("Accept", strings.Join([]string{
+		mediaTypeDockerManifest,
+		mediaTypeDockerManifestList,
+		mediaTypeOCIManifest,
+		mediaTypeOCIIndex,
+	}, ", "))
 
-	manifest, err := h.hub.ManifestV2(img, tag)
+	resp, err := h.hub.Client.Do(req)
 	if err != nil {
-		logrus.WithFields(logFields).Warn(err)
-		return nil, err
+		return nil, "", err
 	}
-	logrus.WithFields(logFields).Tracef("response: %+v", manifest)
+	defer resp.Body.Close()
 
-	blob, err := h.hub.DownloadBlob(img, manifest.Config.Digest)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		logrus.WithFields(logFields).Warn(err)
-		return nil, err
+		return nil, "", err
+	}
+	// Error bodies would decode as a manifest without layers or platforms.
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("GET %s: unexpected status %d: %s", url, resp.StatusCode, strings.TrimSpace(string(body)))
 	}
-	logrus.WithFields(logFields).Tracef("response: %+v", blob)
 
-	bytes, err := io.ReadAll(blob)
+	manifest := &manifestResponse{}
+	if err := json.Unmarshal(body, manifest); err != nil {
+		return nil, "", err
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = strings.Split(resp.Header.Get("Content-Type"), ";")[0]
+	}
+	switch manifest.MediaType {
+	case mediaTypeDockerManifest, mediaTypeOCIManifest, mediaTypeDockerManifestList, mediaTypeOCIIndex:
+	default:
+		return nil, "", fmt.Errorf("unsupported manifest media type %q", manifest.MediaType)
+	}
+
+	return manifest, digest.FromBytes(body).String(), nil
+}
+
+func (h regHelper) getConfig(img string, config descriptor) (*blobResponse, error) {
+	blob, err := h.hub.DownloadBlob(img, digest.Digest(config.Digest))
 	if err != nil {
-		logrus.WithFields(logFields).Warn(err)
 		return nil, err
 	}
-	logrus.WithFields(logFields).Tracef("response: %+v", string(bytes))
+	defer blob.Close()
 
-	var blobResp blobResponse
-	err = json.Unmarshal(bytes, &blobResp)
+	bytes, err := io.ReadAll(blob)
 	if err != nil {
-		logrus.WithFields(logFields).Warn(err)
 		return nil, err
 	}
+	logrus.WithField("image", img).Tracef("response: %+v", string(bytes))
 
-	total := uint64(manifest.Config.Size)
-	for _, layer := range manifest.Layers {
-		total += uint64(layer.Size)
+	blobResp := &blobResponse{}
+	if err := json.Unmarshal(bytes, blobResp); err != nil {
+		return nil, err
 	}
+	return blobResp, nil
+}
+
+func (h regHelper) Prefix() string {
+	return h.RegPrefix
+}
+
+func (h regHelper) HasLabels() bool {
+	return true
+}
+
+func (h regHelper) ResolveDigest(image string) (string, error) {
+	img, tag := splitImageTag(h, image)
+	_, dgst, err := h.getManifest(img, tag)
+	return dgst, err
+}
 
-	meta := imageMeta{
-		Created:   blobResp.Created,
-		TotalSize: total,
+// tagDigest resolves tag once per run, later lookups reuse the digest.
+func (h regHelper) tagDigest(img, tag string) (string, error) {
+	key := img + ":" + tag
+	if dgst, ok := h.digests.Load(key); ok {
+		return dgst.(string), nil
 	}
-	if err := h.cacheManager.Set(context.Background(), key, meta); err != nil {
-		logrus.WithFields(logFields).Warn(err)
+	dgst, err, _ := h.inflight.Do("digest:"+key, func() (interface{}, error) {
+		_, dgst, err := h.getManifest(img, tag)
+		return dgst, err
+	})
+	if err != nil {
+		return "", err
 	}
+	h.digests.Store(key, dgst)
+	return dgst.(string), nil
+}
 
-	return &meta, nil
+// metaCacheKey is versioned, so metadata cached before labels and blobs were
+// read is fetched again. Metadata is cached by digest, which never changes,
+// rather than by tag.
+func metaCacheKey(img, dgst string) string {
+	return "v4:" + img + "@" + dgst
 }
 
-func (h regHelper) GetImageSize(image string) (uint64, error) {
-	img, tag := h.splitImageTag(image)
-	meta, err := h.imageMeta(img, tag)
+// ImageMeta resolves the tag of image live and returns the metadata of the
+// digest it points at, from the cache when it was fetched before.
+func (h regHelper) ImageMeta(image string) (*ImageMeta, error) {
+	img, tag := splitImageTag(h, image)
+	dgst, err := h.tagDigest(img, tag)
 	if err != nil {
-		return 0, err
+		logrus.WithField("image", image).Warn(err)
+		return nil, err
 	}
-	return meta.TotalSize, err
+	key := metaCacheKey(img, dgst)
+	if meta, err := h.cacheManager.Get(context.TODO(), key); err == nil && meta.Digest == dgst {
+		return &meta, nil
+	}
+
+	// Concurrent lookups of the same image share a single fetch.
+	meta, err, _ := h.inflight.Do(key, func() (interface{}, error) {
+		return h.fetchImageMeta(img, dgst)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta.(*ImageMeta), nil
 }
 
-func (h regHelper) GetImageDate(image string) (*time.Time, error) {
-	img, tag := h.splitImageTag(image)
-	meta, err := h.imageMeta(img, tag)
+func (h regHelper) fetchImageMeta(img, ref string) (*ImageMeta, error) {
+	logFields := logrus.Fields{
+		"image": img + "@" + ref,
+	}
+
+	manifest, dgst, err := h.getManifest(img, ref)
 	if err != nil {
+		logrus.WithFields(logFields).Warn(err)
 		return nil, err
 	}
-	return &meta.Created, nil
+	logrus.WithFields(logFields).Tracef("response: %+v", manifest)
+
+	meta := ImageMeta{
+		Digest: dgst,
+		Labels: map[string]string{},
+		Blobs:  map[string]uint64{},
+	}
+
+	// Manifest lists and OCI indexes have no config of their own, the
+	// created date, size and labels come from the platform manifests.
+	platforms := []*manifestResponse{manifest}
+	if manifest.isIndex() {
+		platforms = []*manifestResponse{}
+		for _, child := range manifest.Manifests {
+			childManifest, _, err := h.getManifest(img, child.Digest)
+			if err != nil {
+				logrus.WithFields(logFields).Warn(err)
+				return nil, err
+			}
+			if childManifest.isIndex() {
+				err := fmt.Errorf("nested index %s is not supported", child.Digest)
+				logrus.WithFields(logFields).Warn(err)
+				return nil, err
+			}
+			platforms = append(platforms, childManifest)
+			meta.Children = append(meta.Children, child.Digest)
+		}
+	}
+
+	for _, platform := range platforms {
+		config, err := h.getConfig(img, platform.Config)
+		if err != nil {
+			logrus.WithFields(logFields).Warn(err)
+			return nil, err
+		}
+		if config.Created.After(meta.Created) {
+			meta.Created = config.Created
+		}
+		for k, v := range config.Config.Labels {
+			if _, ok := meta.Labels[k]; !ok {
+				meta.Labels[k] = v
+			}
+		}
+
+		meta.TotalSize += uint64(platform.Config.Size)
+		meta.Blobs[platform.Config.Digest] = uint64(platform.Config.Size)
+		for _, layer := range platform.Layers {
+			meta.TotalSize += uint64(layer.Size)
+			meta.Blobs[layer.Digest] = uint64(layer.Size)
+		}
+	}
+
+	if err := h.cacheManager.Set(context.Background(), metaCacheKey(img, dgst), meta); err != nil {
+		logrus.WithFields(logFields).Warn(err)
+	}
+
+	return &meta, nil
 }
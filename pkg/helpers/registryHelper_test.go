@@ -0,0 +1,371 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// fakeV2 is a registry v2 API in memory.
+type fakeV2 struct {
+	mu        sync.Mutex
+	manifests map[string][]byte // repo@digest
+	types     map[string]string // repo@digest
+	tags      map[string]string // repo:tag -> digest
+	blobs     map[string][]byte // digest
+	deleted   []string
+	// status makes requests for a path fail with the status.
+	status map[string]int
+
+	// links sends a Link header with every page but the last.
+	links bool
+	// pageCap caps catalog and tag pages below the n asked for.
+	pageCap int
+	// maxN rejects larger page sizes with PAGINATION_NUMBER_INVALID.
+	maxN int
+	// ignoreLast serves every page from the start.
+	ignoreLast bool
+}
+
+func newFakeV2(t *testing.T) (*fakeV2, *httptest.Server) {
+	f := &fakeV2{
+		manifests: map[string][]byte{},
+		types:     map[string]string{},
+		tags:      map[string]string{},
+		blobs:     map[string][]byte{},
+		status:    map[string]int{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+// inTempDir runs the test in an empty directory, so the metadata cache
+// starts empty and isn't left behind.
+func inTempDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// push stores an image of a single layer with the size and labels under
+// repo:tag and returns its digest.
+func (f *fakeV2) push(repo, tag string, created time.Time, layerSize int64, labels map[string]string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	config, _ := json.Marshal(map[string]interface{}{
+		"created": created,
+		"config":  map[string]interface{}{"Labels": labels},
+	})
+	configDigest := digest.FromBytes(config).String()
+	f.blobs[configDigest] = config
+	layerDigest := digest.FromString(fmt.Sprintf("%s:%s:%d", repo, tag, created.UnixNano())).String()
+
+	manifest, _ := json.Marshal(manifestResponse{
+		MediaType: mediaTypeDockerManifest,
+		Config:    descriptor{MediaType: "application/vnd.docker.container.image.v1+json", Digest: configDigest, Size: int64(len(config))},
+		Layers:    []descriptor{{MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", Digest: layerDigest, Size: layerSize}},
+	})
+	return f.store(repo, tag, mediaTypeDockerManifest, manifest)
+}
+
+// pushIndex stores an OCI index of the children under repo:tag.
+func (f *fakeV2) pushIndex(repo, tag string, children ...string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	index := manifestResponse{MediaType: mediaTypeOCIIndex}
+	for _, child := range children {
+		index.Manifests = append(index.Manifests, descriptor{MediaType: f.types[repo+"@"+child], Digest: child, Size: int64(len(f.manifests[repo+"@"+child]))})
+	}
+	body, _ := json.Marshal(index)
+	return f.store(repo, tag, mediaTypeOCIIndex, body)
+}
+
+func (f *fakeV2) store(repo, tag, mediaType string, body []byte) string {
+	dgst := digest.FromBytes(body).String()
+	f.manifests[repo+"@"+dgst] = body
+	f.types[repo+"@"+dgst] = mediaType
+	if tag != "" {
+		f.tags[repo+":"+tag] = dgst
+	}
+	return dgst
+}
+
+func (f *fakeV2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if status, ok := f.status[r.URL.Path]; ok {
+		// Proxies in front of registries keep the content type of the
+		// request, so the body alone must not pass as a manifest.
+		w.Header().Set("Content-Type", mediaTypeDockerManifest)
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"errors":[{"code":"DENIED"}]}`)
+		return
+	}
+
+	// page writes the entries after last, at most n of them.
+	page := func(key string, entries []string) {
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n <= 0 {
+			n = len(entries)
+		}
+		if f.maxN > 0 && n > f.maxN {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"PAGINATION_NUMBER_INVALID"}]}`)
+			return
+		}
+		if f.pageCap > 0 && n > f.pageCap {
+			n = f.pageCap
+		}
+		sort.Strings(entries)
+		start := 0
+		if last := r.URL.Query().Get("last"); last != "" && !f.ignoreLast {
+			start = sort.SearchStrings(entries, last)
+			if start < len(entries) && entries[start] == last {
+				start++
+			}
+		}
+		end := start + n
+		if end >= len(entries) {
+			end = len(entries)
+		} else if f.links {
+			next := url.Values{"n": {strconv.Itoa(n)}, "last": {entries[end-1]}}
+			w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+		}
+		json.NewEncoder(w).Encode(map[string][]string{key: entries[start:end]})
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case r.URL.Path == "/v2/":
+		fmt.Fprint(w, "{}")
+	case path == "_catalog":
+		repos := map[string]bool{}
+		for key := range f.tags {
+			repo, _, _ := strings.Cut(key, ":")
+			repos[repo] = true
+		}
+		page("repositories", sorted(repos))
+	case strings.HasSuffix(path, "/tags/list"):
+		repo := strings.TrimSuffix(path, "/tags/list")
+		tags := []string{}
+		for key := range f.tags {
+			if r, tag, _ := strings.Cut(key, ":"); r == repo {
+				tags = append(tags, tag)
+			}
+		}
+		page("tags", tags)
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		repo, ref := path[:i], path[i+len("/manifests/"):]
+		dgst := ref
+		if !strings.HasPrefix(ref, "sha256:") {
+			dgst = f.tags[repo+":"+ref]
+		}
+		body, ok := f.manifests[repo+"@"+dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			f.deleted = append(f.deleted, repo+"@"+dgst)
+			delete(f.manifests, repo+"@"+dgst)
+			for key, tagDigest := range f.tags {
+				if strings.HasPrefix(key, repo+":") && tagDigest == dgst {
+					delete(f.tags, key)
+				}
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[repo+"@"+dgst])
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.Write(body)
+	case strings.Contains(path, "/blobs/"):
+		dgst := path[strings.LastIndex(path, "/")+1:]
+		blob, ok := f.blobs[dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(blob)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestRegHelper(t *testing.T, server *httptest.Server) *regHelper {
+	h, err := NewRegHelper(server.URL, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestRegHelperImageMetaFollowsMovedTags(t *testing.T) {
+	inTempDir(t)
+	f, server := newFakeV2(t)
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := f.push("app", "latest", created, 10, nil)
+
+	h := newTestRegHelper(t, server)
+	image := h.Prefix() + "/app:latest"
+	meta, err := h.ImageMeta(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Digest != first {
+		t.Fatalf("digest = %s, want %s", meta.Digest, first)
+	}
+
+	// A later run shares the cache, but must see where the tag points now.
+	second := f.push("app", "latest", created.AddDate(0, 1, 0), 20, nil)
+	h = newTestRegHelper(t, server)
+	meta, err = h.ImageMeta(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Digest != second {
+		t.Errorf("digest after moving the tag = %s, want %s", meta.Digest, second)
+	}
+	if meta.TotalSize == 0 || !meta.Created.Equal(created.AddDate(0, 1, 0)) {
+		t.Errorf("metadata of the moved tag is stale: %+v", meta)
+	}
+}
+
+func TestRegHelperDeleteDigests(t *testing.T) {
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		move    bool
+		wantErr bool
+	}{
+		{name: "unchanged tags are deleted"},
+		{name: "moved tags are not deleted", move: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			f, server := newFakeV2(t)
+			dgst := f.push("app", "1.0", created, 10, nil)
+			h := newTestRegHelper(t, server)
+
+			groups := GroupByDigest(h, []string{h.Prefix() + "/app:1.0"})
+			if tt.move {
+				f.push("app", "1.0", created.AddDate(0, 1, 0), 10, nil)
+			}
+			err := h.DeleteDigests(groups)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DeleteDigests() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			want := []string{"app@" + dgst}
+			if tt.move {
+				want = nil
+			}
+			if strings.Join(f.deleted, ",") != strings.Join(want, ",") {
+				t.Errorf("deleted %v, want %v", f.deleted, want)
+			}
+		})
+	}
+}
+
+func TestRegHelperManifestErrors(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusNotModified, http.StatusUnauthorized, http.StatusNotFound, http.StatusTooManyRequests} {
+		for _, wrapped := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%d wrapped=%v", status, wrapped), func(t *testing.T) {
+				inTempDir(t)
+				f, server := newFakeV2(t)
+				f.push("app", "1.0", time.Now(), 10, nil)
+				h := newTestRegHelper(t, server)
+				if !wrapped {
+					// Without the error transport of the registry client
+					// every status reaches getManifest.
+					h.hub.Client = server.Client()
+				}
+				f.status["/v2/app/manifests/1.0"] = status
+
+				image := h.Prefix() + "/app:1.0"
+				if dgst, err := h.ResolveDigest(image); err == nil {
+					t.Errorf("ResolveDigest() = %s, want an error", dgst)
+				}
+				if meta, err := h.ImageMeta(image); err == nil {
+					t.Errorf("ImageMeta() = %+v, want an error", meta)
+				}
+			})
+		}
+	}
+}
+
+func TestRegHelperWalkImages(t *testing.T) {
+	tests := []struct {
+		name             string
+		pageSize         int
+		links            bool
+		pageCap          int
+		maxN             int
+		ignoreLast       bool
+		repositoryPrefix string
+		want             int
+		wantErr          bool
+	}{
+		{name: "link headers", pageSize: 2, links: true, want: 25},
+		{name: "capped pages with link headers", pageSize: 5, links: true, pageCap: 2, want: 25},
+		{name: "capped pages without link headers", pageSize: 5, pageCap: 2, want: 25},
+		{name: "full last page", pageSize: 5, want: 25},
+		{name: "rejected page size", pageSize: 10, maxN: 3, want: 25},
+		{name: "repository prefix", pageSize: 5, pageCap: 2, repositoryPrefix: "app-c", want: 5},
+		{name: "ignored last", pageSize: 2, ignoreLast: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			f, server := newFakeV2(t)
+			for _, repo := range []string{"app-a", "app-b", "app-c", "app-d", "app-e"} {
+				for i := 0; i < 5; i++ {
+					f.push(repo, fmt.Sprintf("1.%d", i), time.Now(), 10, nil)
+				}
+			}
+			h := newTestRegHelper(t, server)
+			f.links, f.pageCap, f.maxN, f.ignoreLast = tt.links, tt.pageCap, tt.maxN, tt.ignoreLast
+			h.PageSize = tt.pageSize
+			h.RepositoryPrefix = tt.repositoryPrefix
+
+			images := map[string]bool{}
+			err := h.WalkImages(func(image string) { images[image] = true })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WalkImages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(images) != tt.want {
+				t.Errorf("WalkImages() found %d images, want %d: %v", len(images), tt.want, sorted(images))
+			}
+			for image := range images {
+				if !strings.HasPrefix(image, h.Prefix()+"/"+tt.repositoryPrefix) {
+					t.Errorf("WalkImages() found %s outside of %q", image, tt.repositoryPrefix)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+package helpers
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry serves metadata from memory. images keeps the order the
+// images are walked in.
+type fakeRegistry struct {
+	images  []string
+	metas   map[string]*ImageMeta
+	errs    map[string]error
+	deleted []DigestGroup
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		metas: map[string]*ImageMeta{},
+		errs:  map[string]error{},
+	}
+}
+
+// add registers repo:tag pointing at meta and returns the image reference.
+func (r *fakeRegistry) add(repo, tag string, meta ImageMeta) string {
+	image := r.Prefix() + "/" + repo + ":" + tag
+	r.images = append(r.images, image)
+	r.metas[image] = &meta
+	return image
+}
+
+// fail registers repo:tag whose metadata can't be fetched.
+func (r *fakeRegistry) fail(repo, tag string) string {
+	image := r.Prefix() + "/" + repo + ":" + tag
+	r.images = append(r.images, image)
+	r.errs[image] = fmt.Errorf("no metadata for %s", image)
+	return image
+}
+
+func (r *fakeRegistry) Prefix() string {
+	return "registry.test"
+}
+
+func (r *fakeRegistry) WalkImages(fn func(image string)) error {
+	for _, image := range r.images {
+		fn(image)
+	}
+	return nil
+}
+
+func (r *fakeRegistry) ImageMeta(image string) (*ImageMeta, error) {
+	if err, ok := r.errs[image]; ok {
+		return nil, err
+	}
+	meta, ok := r.metas[image]
+	if !ok {
+		return nil, fmt.Errorf("unknown image %s", image)
+	}
+	return meta, nil
+}
+
+func (r *fakeRegistry) ResolveDigest(image string) (string, error) {
+	meta, err := r.ImageMeta(image)
+	if err != nil {
+		return "", err
+	}
+	return meta.Digest, nil
+}
+
+func (r *fakeRegistry) DeleteDigests(groups []DigestGroup) error {
+	r.deleted = append(r.deleted, groups...)
+	return nil
+}
+
+func TestGroupByDigest(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(r *fakeRegistry)
+		groups []DigestGroup
+	}{
+		{
+			name: "tags of a digest are grouped",
+			setup: func(r *fakeRegistry) {
+				r.add("app", "1.0", ImageMeta{Digest: "sha256:a"})
+				r.add("app", "latest", ImageMeta{Digest: "sha256:a"})
+				r.add("app", "0.9", ImageMeta{Digest: "sha256:b"})
+			},
+			groups: []DigestGroup{
+				{Repository: "app", Digest: "sha256:a", Tags: []string{"1.0", "latest"}, Images: []string{"registry.test/app:1.0", "registry.test/app:latest"}},
+				{Repository: "app", Digest: "sha256:b", Tags: []string{"0.9"}, Images: []string{"registry.test/app:0.9"}},
+			},
+		},
+		{
+			name: "same digest in two repositories",
+			setup: func(r *fakeRegistry) {
+				r.add("a", "1", ImageMeta{Digest: "sha256:a"})
+				r.add("b", "1", ImageMeta{Digest: "sha256:a"})
+			},
+			groups: []DigestGroup{
+				{Repository: "a", Digest: "sha256:a", Tags: []string{"1"}, Images: []string{"registry.test/a:1"}},
+				{Repository: "b", Digest: "sha256:a", Tags: []string{"1"}, Images: []string{"registry.test/b:1"}},
+			},
+		},
+		{
+			name: "index children are carried along",
+			setup: func(r *fakeRegistry) {
+				r.add("app", "1.0", ImageMeta{Digest: "sha256:index", Children: []string{"sha256:amd64", "sha256:arm64"}})
+			},
+			groups: []DigestGroup{
+				{Repository: "app", Digest: "sha256:index", Tags: []string{"1.0"}, Images: []string{"registry.test/app:1.0"}, Children: []string{"sha256:amd64", "sha256:arm64"}},
+			},
+		},
+		{
+			name: "images without metadata get an unknown group",
+			setup: func(r *fakeRegistry) {
+				r.fail("app", "broken")
+				r.add("app", "1.0", ImageMeta{Digest: "sha256:a"})
+			},
+			groups: []DigestGroup{
+				{Repository: "app", Tags: []string{"broken"}, Images: []string{"registry.test/app:broken"}, Unknown: true},
+				{Repository: "app", Digest: "sha256:a", Tags: []string{"1.0"}, Images: []string{"registry.test/app:1.0"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newFakeRegistry()
+			tt.setup(reg)
+			groups := GroupByDigest(reg, reg.images)
+			if !reflect.DeepEqual(groups, tt.groups) {
+				t.Errorf("GroupByDigest() = %+v, want %+v", groups, tt.groups)
+			}
+		})
+	}
+}
+
+func TestPruneSharedChildren(t *testing.T) {
+	group := func(repo, digest string, children ...string) DigestGroup {
+		return DigestGroup{Repository: repo, Digest: digest, Children: children}
+	}
+	tests := []struct {
+		name         string
+		toDelete     []DigestGroup
+		toKeep       []DigestGroup
+		wantDelete   []DigestGroup
+		wantKeptMore []DigestGroup
+	}{
+		{
+			name:       "unshared children are deleted",
+			toDelete:   []DigestGroup{group("app", "old", "old-amd64", "old-arm64")},
+			toKeep:     []DigestGroup{group("app", "new", "new-amd64")},
+			wantDelete: []DigestGroup{group("app", "old", "old-amd64", "old-arm64")},
+		},
+		{
+			name:       "children of a kept index stay",
+			toDelete:   []DigestGroup{group("app", "old", "amd64", "arm64")},
+			toKeep:     []DigestGroup{group("app", "new", "amd64", "riscv")},
+			wantDelete: []DigestGroup{group("app", "old", "arm64")},
+		},
+		{
+			name:       "tagged kept children stay",
+			toDelete:   []DigestGroup{group("app", "old", "amd64")},
+			toKeep:     []DigestGroup{group("app", "amd64")},
+			wantDelete: []DigestGroup{group("app", "old")},
+		},
+		{
+			name:         "tagged platform manifest of a kept index is kept",
+			toDelete:     []DigestGroup{group("app", "amd64")},
+			toKeep:       []DigestGroup{group("app", "index", "amd64", "arm64")},
+			wantDelete:   []DigestGroup{},
+			wantKeptMore: []DigestGroup{group("app", "amd64")},
+		},
+		{
+			name:       "same digest in another repository doesn't count",
+			toDelete:   []DigestGroup{group("a", "amd64")},
+			toKeep:     []DigestGroup{group("b", "index", "amd64")},
+			wantDelete: []DigestGroup{group("a", "amd64")},
+		},
+		{
+			name:       "children shared by deleted indexes are deleted once",
+			toDelete:   []DigestGroup{group("app", "one", "amd64"), group("app", "two", "amd64")},
+			wantDelete: []DigestGroup{group("app", "one", "amd64"), group("app", "two")},
+		},
+		{
+			name:       "children deleted as a group of their own are deleted once",
+			toDelete:   []DigestGroup{group("app", "index", "amd64"), group("app", "amd64")},
+			wantDelete: []DigestGroup{group("app", "index"), group("app", "amd64")},
+		},
+		{
+			name:         "nothing is deleted next to images without metadata",
+			toDelete:     []DigestGroup{group("app", "old"), group("other", "old")},
+			toKeep:       []DigestGroup{{Repository: "app", Unknown: true}},
+			wantDelete:   []DigestGroup{group("other", "old")},
+			wantKeptMore: []DigestGroup{group("app", "old")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted, kept := PruneSharedChildren(tt.toDelete, tt.toKeep)
+			if !reflect.DeepEqual(normalize(deleted), normalize(tt.wantDelete)) {
+				t.Errorf("deleted = %+v, want %+v", deleted, tt.wantDelete)
+			}
+			wantKept := append(append([]DigestGroup{}, tt.toKeep...), tt.wantKeptMore...)
+			if !reflect.DeepEqual(normalize(kept), normalize(wantKept)) {
+				t.Errorf("kept = %+v, want %+v", kept, wantKept)
+			}
+		})
+	}
+}
+
+func TestImageMetaRunningDigest(t *testing.T) {
+	index := ImageMeta{Digest: "index", Children: []string{"amd64", "arm64"}}
+	tests := []struct {
+		name    string
+		meta    ImageMeta
+		digests map[string]bool
+		want    string
+	}{
+		{name: "index", meta: index, digests: map[string]bool{"index": true}, want: "index"},
+		{name: "platform manifest", meta: index, digests: map[string]bool{"arm64": true}, want: "arm64"},
+		{name: "image", meta: ImageMeta{Digest: "amd64"}, digests: map[string]bool{"amd64": true}, want: "amd64"},
+		{name: "not running", meta: index, digests: map[string]bool{"other": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.meta.RunningDigest(tt.digests)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("RunningDigest() = %q, %v, want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+// normalize makes empty and nil children compare equal.
+func normalize(groups []DigestGroup) []DigestGroup {
+	normalized := []DigestGroup{}
+	for _, group := range groups {
+		if len(group.Children) == 0 {
+			group.Children = nil
+		}
+		normalized = append(normalized, group)
+	}
+	return normalized
+}
+
+func TestWalkRepositories(t *testing.T) {
+	tests := []struct {
+		name    string
+		repos   []string
+		stopAt  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "repositories are handed over whole and in order",
+			repos: []string{"a", "a", "b", "c", "c", "c"},
+			want:  []string{"a:2", "b:1", "c:3"},
+		},
+		{
+			name:  "empty registry",
+			repos: []string{},
+			want:  []string{},
+		},
+		{
+			name:    "repository listed twice",
+			repos:   []string{"a", "b", "a"},
+			want:    []string{"a:1"},
+			wantErr: true,
+		},
+		{
+			name:    "error of fn stops the walk",
+			repos:   []string{"a", "b", "c"},
+			stopAt:  "b",
+			want:    []string{"a:1", "b:1"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		for _, concurrency := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, concurrency), func(t *testing.T) {
+				reg := newFakeRegistry()
+				for i, repo := range tt.repos {
+					reg.add(repo, fmt.Sprint(i), ImageMeta{Digest: fmt.Sprintf("sha256:%d", i)})
+				}
+				counting := &countingRegistry{fakeRegistry: reg, fetched: map[string]bool{}}
+
+				got := []string{}
+				err := WalkRepositories(counting, concurrency, func(repo string, images []string) error {
+					for _, image := range images {
+						if !counting.wasFetched(image) {
+							t.Errorf("%s handed over before its metadata was fetched", image)
+						}
+					}
+					got = append(got, fmt.Sprintf("%s:%d", repo, len(images)))
+					if repo == tt.stopAt {
+						return fmt.Errorf("stop")
+					}
+					return nil
+				})
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("WalkRepositories() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("repositories = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// countingRegistry records which images had their metadata fetched.
+type countingRegistry struct {
+	*fakeRegistry
+	mu      sync.Mutex
+	fetched map[string]bool
+}
+
+func (r *countingRegistry) ImageMeta(image string) (*ImageMeta, error) {
+	r.mu.Lock()
+	r.fetched[image] = true
+	r.mu.Unlock()
+	return r.fakeRegistry.ImageMeta(image)
+}
+
+func (r *countingRegistry) wasFetched(image string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fetched[image]
+}
+
+func TestSpaceCounter(t *testing.T) {
+	reg := newFakeRegistry()
+	meta := func(digest string, blobs map[string]uint64) ImageMeta {
+		total := uint64(0)
+		for _, size := range blobs {
+			total += size
+		}
+		return ImageMeta{Digest: digest, TotalSize: total, Blobs: blobs}
+	}
+	old := reg.add("app", "old", meta("sha256:old", map[string]uint64{"base": 100, "old": 10}))
+	kept := reg.add("app", "new", meta("sha256:new", map[string]uint64{"base": 100, "new": 20}))
+	other := reg.add("other", "old", meta("sha256:other", map[string]uint64{"old": 10, "other": 5}))
+
+	counter := NewSpaceCounter()
+	// Repositories are added one at a time, a blob kept in a later
+	// repository isn't reclaimable either.
+	counter.Add(reg,
+		[]DigestGroup{{Repository: "app", Digest: "sha256:old", Images: []string{old}}},
+		[]DigestGroup{{Repository: "app", Digest: "sha256:new", Images: []string{kept}}, {Repository: "app", Unknown: true}},
+	)
+	counter.Add(reg,
+		[]DigestGroup{{Repository: "other", Digest: "sha256:other", Images: []string{other}}},
+		nil,
+	)
+	total, byRepo := counter.Space()
+
+	if want := (SpaceUsage{Logical: 125, Reclaimable: 15}); total != want {
+		t.Errorf("total = %+v, want %+v", total, want)
+	}
+	wantByRepo := map[string]SpaceUsage{
+		"app":   {Logical: 110, Reclaimable: 10},
+		"other": {Logical: 15, Reclaimable: 15},
+	}
+	if !reflect.DeepEqual(byRepo, wantByRepo) {
+		t.Errorf("by repository = %+v, want %+v", byRepo, wantByRepo)
+	}
+}
+
+func TestNewRegistry(t *testing.T) {
+	var got RegistryOptions
+	RegisterRegistryType("fake", func(opts RegistryOptions) (Registry, error) {
+		got = opts
+		return newFakeRegistry(), nil
+	})
+	RegisterRegistryType("broken", func(opts RegistryOptions) (Registry, error) {
+		return nil, fmt.Errorf("broken")
+	})
+	t.Cleanup(func() {
+		delete(registryTypes, "fake")
+		delete(registryTypes, "broken")
+	})
+
+	tests := []struct {
+		name         string
+		registryType string
+		url          string
+		wantURL      string
+		wantErr      bool
+	}{
+		{name: "type from the URL scheme", url: "fake://registry.test", wantURL: "https://registry.test"},
+		{name: "type from the flag", registryType: "fake", url: "https://registry.test", wantURL: "https://registry.test"},
+		{name: "flag wins over the scheme", registryType: "fake", url: "broken://registry.test", wantURL: "https://registry.test"},
+		{name: "unknown type", registryType: "nope", url: "https://registry.test", wantErr: true},
+		{name: "unknown scheme", url: "nope://registry.test", wantErr: true},
+		{name: "factory errors", url: "broken://registry.test", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = RegistryOptions{}
+			reg, err := NewRegistry(tt.registryType, RegistryOptions{URL: tt.url})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRegistry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if reg != nil {
+					t.Errorf("NewRegistry() = %v with an error", reg)
+				}
+				return
+			}
+			if got.URL != tt.wantURL {
+				t.Errorf("factory got URL %q, want %q", got.URL, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestSpaceCounterApproximate(t *testing.T) {
+	reg := newFakeRegistry()
+	known := reg.add("app", "old", ImageMeta{Digest: "sha256:app", TotalSize: 10, Blobs: map[string]uint64{"layer": 10}})
+	unknown := reg.add("other", "old", ImageMeta{Digest: "sha256:other", TotalSize: 20})
+
+	counter := NewSpaceCounter()
+	counter.Add(reg, []DigestGroup{{Repository: "app", Digest: "sha256:app", Images: []string{known}}}, nil)
+	counter.Add(reg, []DigestGroup{{Repository: "other", Digest: "sha256:other", Images: []string{unknown}}}, nil)
+	total, byRepo := counter.Space()
+
+	if want := (SpaceUsage{Logical: 30, Reclaimable: 30, Approximate: true}); total != want {
+		t.Errorf("total = %+v, want %+v", total, want)
+	}
+	wantByRepo := map[string]SpaceUsage{
+		"app":   {Logical: 10, Reclaimable: 10},
+		"other": {Logical: 20, Reclaimable: 20, Approximate: true},
+	}
+	if !reflect.DeepEqual(byRepo, wantByRepo) {
+		t.Errorf("by repository = %+v, want %+v", byRepo, wantByRepo)
+	}
+}
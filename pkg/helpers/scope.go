@@ -0,0 +1,154 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Scope limits which namespaces and objects of a cluster are searched for
+// images. The zero Scope searches everything.
+type Scope struct {
+	Namespaces        []string
+	ExcludeNamespaces []string
+	LabelSelector     string
+}
+
+// NewScope picks the scope of kubeContext from option values of the form
+// "value" or "value@context". Values naming kubeContext take precedence over
+// values without a context. Namespaces are comma separated.
+func NewScope(kubeContext string, namespaces, excludeNamespaces, labelSelectors []string) (Scope, error) {
+	scope := Scope{
+		Namespaces:        splitNamespaces(contextValues(namespaces, kubeContext)),
+		ExcludeNamespaces: splitNamespaces(contextValues(excludeNamespaces, kubeContext)),
+	}
+
+	selectors := contextValues(labelSelectors, kubeContext)
+	if len(selectors) > 1 {
+		return Scope{}, fmt.Errorf("context %q has more than one label selector: %s", kubeContext, strings.Join(selectors, ", "))
+	}
+	if len(selectors) == 1 {
+		if _, err := labels.Parse(selectors[0]); err != nil {
+			return Scope{}, fmt.Errorf("invalid label selector for context %q: %w", kubeContext, err)
+		}
+		scope.LabelSelector = selectors[0]
+	}
+	return scope, nil
+}
+
+// contextValues returns the values for kubeContext, or the values without a
+// context when none name it. Namespaces and selectors can't contain "@", so
+// context names can.
+func contextValues(values []string, kubeContext string) []string {
+	global := []string{}
+	specific := []string{}
+	for _, value := range values {
+		value, valueContext, found := strings.Cut(value, "@")
+		if !found {
+			global = append(global, value)
+		} else if valueContext == kubeContext {
+			specific = append(specific, value)
+		}
+	}
+	if len(specific) > 0 {
+		return specific
+	}
+	return global
+}
+
+func splitNamespaces(values []string) []string {
+	namespaces := []string{}
+	for _, value := range values {
+		for _, namespace := range strings.Split(value, ",") {
+			if namespace = strings.TrimSpace(namespace); namespace != "" {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+	}
+	return namespaces
+}
+
+func (s Scope) excludes(namespace string) bool {
+	for _, excluded := range s.ExcludeNamespaces {
+		if namespace == excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// scopedLister lists resources within a scope. Without namespaces in the
+// scope it lists across all namespaces, and falls back to listing namespace
+// by namespace when that is forbidden, as it is for users with only
+// namespaced roles.
+type scopedLister struct {
+	clientset kubernetes.Interface
+	scope     Scope
+
+	// namespaces are looked up on the first forbidden cluster-wide list.
+	namespaces []string
+}
+
+func newScopedLister(clientset kubernetes.Interface, scope Scope) *scopedLister {
+	return &scopedLister{
+		clientset: clientset,
+		scope:     scope,
+	}
+}
+
+// list calls list for all namespaces at once, or for every namespace in
+// scope. A namespace where listing resource is forbidden fails the list, as
+// images used there would look unused.
+func (l *scopedLister) list(resource string, list func(namespace string, opts v1.ListOptions) error) error {
+	opts := v1.ListOptions{LabelSelector: l.scope.LabelSelector}
+
+	namespaces := l.scope.Namespaces
+	if len(namespaces) == 0 {
+		err := list("", opts)
+		if !apierrors.IsForbidden(err) {
+			return err
+		}
+		logrus.Debugf("Listing %s in all namespaces is forbidden, listing them per namespace", resource)
+		if namespaces, err = l.allNamespaces(); err != nil {
+			return err
+		}
+	}
+
+	for _, namespace := range namespaces {
+		if l.scope.excludes(namespace) {
+			continue
+		}
+		err := list(namespace, opts)
+		if apierrors.IsForbidden(err) {
+			return fmt.Errorf("listing %s in namespace %s is forbidden, leave it out with --exclude-namespaces: %w", resource, namespace, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *scopedLister) allNamespaces() ([]string, error) {
+	if l.namespaces != nil {
+		return l.namespaces, nil
+	}
+	namespaceList, err := l.clientset.CoreV1().Namespaces().List(context.Background(), v1.ListOptions{})
+	if apierrors.IsForbidden(err) {
+		return nil, fmt.Errorf("listing namespaces is forbidden, set the namespaces to search with --namespaces: %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.namespaces = []string{}
+	for _, namespace := range namespaceList.Items {
+		l.namespaces = append(l.namespaces, namespace.Name)
+	}
+	return l.namespaces, nil
+}
@@ -0,0 +1,156 @@
+package helpers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestNewScope(t *testing.T) {
+	tests := []struct {
+		name           string
+		context        string
+		namespaces     []string
+		labelSelectors []string
+		want           Scope
+		wantErr        bool
+	}{
+		{
+			name:       "global namespaces",
+			context:    "prod",
+			namespaces: []string{"a,b", " c "},
+			want:       Scope{Namespaces: []string{"a", "b", "c"}, ExcludeNamespaces: []string{}},
+		},
+		{
+			name:       "namespaces of the context win",
+			context:    "prod",
+			namespaces: []string{"a", "b@prod", "c@dev"},
+			want:       Scope{Namespaces: []string{"b"}, ExcludeNamespaces: []string{}},
+		},
+		{
+			name:       "namespaces of other contexts",
+			context:    "prod",
+			namespaces: []string{"c@dev"},
+			want:       Scope{Namespaces: []string{}, ExcludeNamespaces: []string{}},
+		},
+		{
+			name:           "label selector",
+			context:        "prod",
+			labelSelectors: []string{"team=a@prod", "team=b"},
+			want:           Scope{Namespaces: []string{}, ExcludeNamespaces: []string{}, LabelSelector: "team=a"},
+		},
+		{
+			name:           "two label selectors",
+			labelSelectors: []string{"team=a", "team=b"},
+			wantErr:        true,
+		},
+		{
+			name:           "invalid label selector",
+			labelSelectors: []string{"team in a"},
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewScope(tt.context, tt.namespaces, nil, tt.labelSelectors)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewScope() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewScope() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScopedListerList(t *testing.T) {
+	tests := []struct {
+		name  string
+		scope Scope
+		// forbidden lists the namespaces where listing pods is forbidden,
+		// "" for all namespaces at once and "namespaces" for listing them.
+		forbidden []string
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name: "all namespaces at once",
+			want: []string{""},
+		},
+		{
+			name:      "per namespace when forbidden cluster-wide",
+			forbidden: []string{""},
+			want:      []string{"", "a", "b", "c"},
+		},
+		{
+			name:      "excluded namespaces are not listed",
+			scope:     Scope{ExcludeNamespaces: []string{"b"}},
+			forbidden: []string{"", "b"},
+			want:      []string{"", "a", "c"},
+		},
+		{
+			name:      "forbidden namespace fails the fallback",
+			forbidden: []string{"", "b"},
+			wantErr:   true,
+		},
+		{
+			name:  "namespaces in scope",
+			scope: Scope{Namespaces: []string{"a", "c"}},
+			want:  []string{"a", "c"},
+		},
+		{
+			name:      "forbidden namespace in scope fails",
+			scope:     Scope{Namespaces: []string{"a", "b"}},
+			forbidden: []string{"b"},
+			wantErr:   true,
+		},
+		{
+			name:      "listing namespaces forbidden",
+			forbidden: []string{"", "namespaces"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(
+				&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "a"}},
+				&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "b"}},
+				&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "c"}},
+			)
+			forbidden := map[string]bool{}
+			for _, namespace := range tt.forbidden {
+				forbidden[namespace] = true
+			}
+			clientset.PrependReactor("list", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if forbidden["namespaces"] {
+					return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "namespaces"}, "", nil)
+				}
+				return false, nil, nil
+			})
+
+			listed := []string{}
+			lister := newScopedLister(clientset, tt.scope)
+			err := lister.list("pods", func(namespace string, opts v1.ListOptions) error {
+				listed = append(listed, namespace)
+				if forbidden[namespace] {
+					return apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "", nil)
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("list() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && strings.Join(listed, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("listed namespaces %q, want %q", listed, tt.want)
+			}
+		})
+	}
+}
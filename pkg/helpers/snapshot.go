@@ -0,0 +1,56 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Snapshot is the set of images in use in a cluster at a point in time, so
+// clusters regclean can't reach can still protect their images.
+type Snapshot struct {
+	Context string         `json:"context"`
+	Created time.Time      `json:"created"`
+	Images  []ClusterImage `json:"images"`
+}
+
+// WriteSnapshot writes snapshot to path as JSON, or to stdout when path is "-".
+func WriteSnapshot(path string, snapshot Snapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot. Snapshots older
+// than maxAge are rejected, as images deployed since would not be protected.
+// A maxAge of zero accepts any age. Snapshots dated in the future are always
+// rejected, their age can't be told.
+func ReadSnapshot(path string, maxAge time.Duration) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %w", path, err)
+	}
+	if snapshot.Created.IsZero() {
+		return nil, fmt.Errorf("snapshot %s has no creation time", path)
+	}
+	age := time.Since(snapshot.Created)
+	if age < 0 {
+		return nil, fmt.Errorf("snapshot %s of %s was created %s in the future, check the clock of the machine that took it", path, snapshot.Context, (-age).Round(time.Second))
+	}
+	if maxAge > 0 && age > maxAge {
+		return nil, fmt.Errorf("snapshot %s of %s is %s old, more than the maximum of %s", path, snapshot.Context, age.Round(time.Minute), maxAge)
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,52 @@
+package helpers
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadSnapshot(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name    string
+		created time.Time
+		maxAge  time.Duration
+		wantErr string
+	}{
+		{name: "fresh", created: now.Add(-time.Hour), maxAge: 24 * time.Hour},
+		{name: "too old", created: now.Add(-48 * time.Hour), maxAge: 24 * time.Hour, wantErr: "old"},
+		{name: "any age", created: now.Add(-48 * time.Hour)},
+		{name: "future", created: now.Add(time.Hour), maxAge: 24 * time.Hour, wantErr: "in the future"},
+		{name: "future with any age", created: now.Add(time.Hour), wantErr: "in the future"},
+		{name: "no creation time", wantErr: "no creation time"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot.json")
+			snapshot := Snapshot{
+				Context: "prod",
+				Created: tt.created,
+				Images:  []ClusterImage{{Image: "registry.test/app:1.0", Seen: tt.created}},
+			}
+			if err := WriteSnapshot(path, snapshot); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ReadSnapshot(path, tt.maxAge)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ReadSnapshot() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Images) != 1 || !got.Images[0].Seen.Equal(tt.created) {
+				t.Errorf("ReadSnapshot() images = %+v", got.Images)
+			}
+		})
+	}
+}
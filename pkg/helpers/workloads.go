@@ -0,0 +1,156 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+)
+
+// WorkloadDefinition tells the cluster helper where a custom resource keeps
+// its images. Every path is a JSONPath expression selecting image
+// references, e.g. "{.spec.template.spec.containers[*].image}".
+type WorkloadDefinition struct {
+	Group    string   `json:"group"`
+	Version  string   `json:"version"`
+	Resource string   `json:"resource"`
+	Paths    []string `json:"paths"`
+
+	parsed []*jsonpath.JSONPath
+}
+
+// BuiltinWorkloads covers Argo Rollouts, Knative Services and Revisions and
+// KEDA ScaledJobs, which keep images in resources with no pods while they
+// are scaled to zero.
+var BuiltinWorkloads = []WorkloadDefinition{
+	{
+		Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts",
+		Paths: []string{
+			"{.spec.template.spec.initContainers[*].image}",
+			"{.spec.template.spec.containers[*].image}",
+		},
+	},
+	{
+		Group: "serving.knative.dev", Version: "v1", Resource: "services",
+		Paths: []string{
+			"{.spec.template.spec.initContainers[*].image}",
+			"{.spec.template.spec.containers[*].image}",
+		},
+	},
+	{
+		Group: "serving.knative.dev", Version: "v1", Resource: "revisions",
+		Paths: []string{
+			"{.spec.initContainers[*].image}",
+			"{.spec.containers[*].image}",
+			// Knative resolves tags to digests when creating a revision.
+			"{.status.containerStatuses[*].imageDigest}",
+			"{.status.initContainerStatuses[*].imageDigest}",
+		},
+	},
+	{
+		Group: "keda.sh", Version: "v1alpha1", Resource: "scaledjobs",
+		Paths: []string{
+			"{.spec.jobTargetRef.template.spec.initContainers[*].image}",
+			"{.spec.jobTargetRef.template.spec.containers[*].image}",
+		},
+	},
+}
+
+// LoadWorkloadDefinitions reads a YAML list of workload definitions.
+func LoadWorkloadDefinitions(path string) ([]WorkloadDefinition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	definitions := []WorkloadDefinition{}
+	if err := yaml.UnmarshalStrict(data, &definitions); err != nil {
+		return nil, fmt.Errorf("failed to parse workload definitions %s: %w", path, err)
+	}
+	for i := range definitions {
+		if err := definitions[i].parse(); err != nil {
+			return nil, fmt.Errorf("invalid workload definitions %s: %w", path, err)
+		}
+	}
+	return definitions, nil
+}
+
+func (d WorkloadDefinition) gvr() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: d.Group, Version: d.Version, Resource: d.Resource}
+}
+
+func (d *WorkloadDefinition) parse() error {
+	if d.Version == "" || d.Resource == "" {
+		return fmt.Errorf("workload %s: version and resource are required", d.gvr())
+	}
+	d.parsed = []*jsonpath.JSONPath{}
+	for _, path := range d.Paths {
+		jp := jsonpath.New(path).AllowMissingKeys(true)
+		if err := jp.Parse(path); err != nil {
+			return fmt.Errorf("workload %s: invalid path %q: %w", d.gvr(), path, err)
+		}
+		d.parsed = append(d.parsed, jp)
+	}
+	return nil
+}
+
+// images lists the resources of the definition in scope of lister and
+// returns the images found on its paths. Resources that aren't installed in
+// the cluster are skipped.
+func (d WorkloadDefinition) images(client dynamic.Interface, lister *scopedLister) ([]ClusterImage, error) {
+	if d.parsed == nil {
+		if err := d.parse(); err != nil {
+			return nil, err
+		}
+	}
+
+	items := []unstructured.Unstructured{}
+	err := lister.list(d.Resource, func(namespace string, opts v1.ListOptions) error {
+		list, err := client.Resource(d.gvr()).Namespace(namespace).List(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		items = append(items, list.Items...)
+		return nil
+	})
+	if apierrors.IsNotFound(err) {
+		logrus.Tracef("Resource %s is not installed, skipping", d.gvr())
+		return []ClusterImage{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	images := []ClusterImage{}
+	for _, item := range items {
+		found := []string{}
+		for i, jp := range d.parsed {
+			results, err := jp.FindResults(item.UnstructuredContent())
+			if err != nil {
+				logrus.Tracef("Failed to read %s of %s/%s: %s", d.Paths[i], item.GetNamespace(), item.GetName(), err)
+				continue
+			}
+			for _, result := range results {
+				for _, value := range result {
+					if image, ok := value.Interface().(string); ok && image != "" {
+						found = append(found, image)
+					}
+				}
+			}
+		}
+		meta := v1.ObjectMeta{
+			Name:            item.GetName(),
+			Namespace:       item.GetNamespace(),
+			OwnerReferences: item.GetOwnerReferences(),
+		}
+		images = append(images, workloadImages(item.GetKind(), meta, found)...)
+	}
+	return images, nil
+}
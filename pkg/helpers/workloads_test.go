@@ -0,0 +1,166 @@
+package helpers
+
+import (
+	"reflect"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// containers returns a container list as found in unstructured objects.
+func containers(images ...string) []interface{} {
+	list := []interface{}{}
+	for _, image := range images {
+		list = append(list, map[string]interface{}{"name": "main", "image": image})
+	}
+	return list
+}
+
+func workload(definition WorkloadDefinition, kind string, spec, status map[string]interface{}) *unstructured.Unstructured {
+	object := map[string]interface{}{
+		"apiVersion": definition.gvr().GroupVersion().String(),
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"namespace": "web", "name": "api"},
+		"spec":       spec,
+	}
+	if status != nil {
+		object["status"] = status
+	}
+	return &unstructured.Unstructured{Object: object}
+}
+
+func podSpec(init, main string) map[string]interface{} {
+	return map[string]interface{}{"initContainers": containers(init), "containers": containers(main)}
+}
+
+func TestWorkloadDefinitionImages(t *testing.T) {
+	rollouts, services, revisions, scaledJobs := BuiltinWorkloads[0], BuiltinWorkloads[1], BuiltinWorkloads[2], BuiltinWorkloads[3]
+	tests := []struct {
+		name       string
+		definition WorkloadDefinition
+		object     *unstructured.Unstructured
+		want       []string
+	}{
+		{
+			name:       "argo rollout",
+			definition: rollouts,
+			object:     workload(rollouts, "Rollout", map[string]interface{}{"template": map[string]interface{}{"spec": podSpec("registry.test/init:1.0", "registry.test/api:1.0")}}, nil),
+			want:       []string{"registry.test/init:1.0", "registry.test/api:1.0"},
+		},
+		{
+			name:       "knative service",
+			definition: services,
+			object:     workload(services, "Service", map[string]interface{}{"template": map[string]interface{}{"spec": podSpec("registry.test/init:1.0", "registry.test/api:1.0")}}, nil),
+			want:       []string{"registry.test/init:1.0", "registry.test/api:1.0"},
+		},
+		{
+			name:       "knative revision",
+			definition: revisions,
+			object: workload(revisions, "Revision", podSpec("registry.test/init:1.0", "registry.test/api:1.0"), map[string]interface{}{
+				"containerStatuses":     []interface{}{map[string]interface{}{"name": "main", "imageDigest": "registry.test/api@sha256:api"}},
+				"initContainerStatuses": []interface{}{map[string]interface{}{"name": "init", "imageDigest": "registry.test/init@sha256:init"}},
+			}),
+			want: []string{"registry.test/init:1.0", "registry.test/api:1.0", "registry.test/api@sha256:api", "registry.test/init@sha256:init"},
+		},
+		{
+			name:       "revision not resolved yet",
+			definition: revisions,
+			object:     workload(revisions, "Revision", podSpec("registry.test/init:1.0", "registry.test/api:1.0"), nil),
+			want:       []string{"registry.test/init:1.0", "registry.test/api:1.0"},
+		},
+		{
+			name:       "keda scaledjob",
+			definition: scaledJobs,
+			object: workload(scaledJobs, "ScaledJob", map[string]interface{}{"jobTargetRef": map[string]interface{}{
+				"template": map[string]interface{}{"spec": podSpec("registry.test/init:1.0", "registry.test/worker:1.0")},
+			}}, nil),
+			want: []string{"registry.test/init:1.0", "registry.test/worker:1.0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{tt.definition.gvr(): tt.object.GetKind() + "List"}, tt.object)
+			lister := newScopedLister(fake.NewSimpleClientset(), Scope{})
+
+			found, err := tt.definition.images(client, lister)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, image := range found {
+				if image.Namespace != "web" || image.OwnerKind != tt.object.GetKind() || image.OwnerName != "api" {
+					t.Errorf("image %s found in %s/%s %s", image.Image, image.Namespace, image.OwnerKind, image.OwnerName)
+				}
+				got = append(got, image.Image)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("images = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkloadDefinitionNotInstalled(t *testing.T) {
+	definition := BuiltinWorkloads[0]
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{definition.gvr(): "RolloutList"})
+	client.PrependReactor("list", definition.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(definition.gvr().GroupResource(), "")
+	})
+	lister := newScopedLister(fake.NewSimpleClientset(), Scope{})
+
+	found, err := definition.images(client, lister)
+	if err != nil {
+		t.Fatalf("images() of a resource that isn't installed: %v", err)
+	}
+	if len(found) != 0 {
+		t.Errorf("images = %v, want none", found)
+	}
+}
+
+func TestLoadWorkloadDefinitions(t *testing.T) {
+	tests := []struct {
+		name        string
+		definitions string
+		want        int
+		wantErr     bool
+	}{
+		{
+			name: "valid",
+			definitions: `- group: example.com
+  version: v1
+  resource: apps
+  paths: ["{.spec.image}", "{.spec.sidecars[*].image}"]
+- version: v1
+  resource: pods
+`,
+			want: 2,
+		},
+		{name: "unknown key", definitions: "- version: v1\n  resource: apps\n  path: \"{.spec.image}\"\n", wantErr: true},
+		{name: "missing resource", definitions: "- group: example.com\n  version: v1\n", wantErr: true},
+		{name: "missing version", definitions: "- group: example.com\n  resource: apps\n", wantErr: true},
+		{name: "invalid path", definitions: "- version: v1\n  resource: apps\n  paths: [\"{.spec.image\"]\n", wantErr: true},
+		{name: "not a list", definitions: "version: v1\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			definitions, err := LoadWorkloadDefinitions(writePolicy(t, tt.definitions))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadWorkloadDefinitions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(definitions) != tt.want {
+				t.Errorf("%d definitions, want %d", len(definitions), tt.want)
+			}
+		})
+	}
+	if _, err := LoadWorkloadDefinitions("does-not-exist.yaml"); err == nil {
+		t.Errorf("LoadWorkloadDefinitions() of a missing file, want an error")
+	}
+}
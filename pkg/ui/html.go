@@ -0,0 +1,253 @@
+package ui
+
+import (
+	"html/template"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// ageBuckets are the upper bounds of the age histogram, the last bucket holds
+// everything older.
+var ageBuckets = []struct {
+	Label string
+	Max   time.Duration
+}{
+	{"< 1 week", 7 * 24 * time.Hour},
+	{"1 week - 1 month", 30 * 24 * time.Hour},
+	{"1 - 3 months", 90 * 24 * time.Hour},
+	{"3 - 6 months", 180 * 24 * time.Hour},
+	{"6 - 12 months", 365 * 24 * time.Hour},
+	{"> 1 year", 0},
+}
+
+type htmlRepository struct {
+	Repository  string
+	Tags        int
+	Used        uint64
+	Unused      uint64
+	Logical     uint64
+	Reclaimable uint64
+	Approximate bool
+	Delete      int
+}
+
+type htmlBucket struct {
+	Label   string
+	Counts  map[string]int
+	Total   int
+	Percent map[string]float64
+}
+
+type htmlStat struct {
+	Filter string
+	Count  int
+}
+
+type htmlReport struct {
+	Report
+	Statuses     []string
+	Totals       map[string]int
+	Sizes        map[string]uint64
+	Repositories []htmlRepository
+	Histogram    []htmlBucket
+	FilterStats  []htmlStat
+}
+
+// WriteHTML renders the report as a single HTML page without any external
+// assets, so it can be archived or mailed as is.
+func (r Report) WriteHTML(w io.Writer) error {
+	statuses := []string{StatusDelete, StatusInUse, StatusKept, StatusError}
+	data := htmlReport{
+		Report:   r,
+		Statuses: statuses,
+		Totals:   map[string]int{},
+		Sizes:    map[string]uint64{},
+	}
+
+	repos := map[string]*htmlRepository{}
+	buckets := make([]htmlBucket, len(ageBuckets))
+	for i, b := range ageBuckets {
+		buckets[i] = htmlBucket{Label: b.Label, Counts: map[string]int{}, Percent: map[string]float64{}}
+	}
+	for _, e := range r.Entries {
+		data.Totals[e.Status]++
+		data.Sizes[e.Status] += e.Size
+
+		repo, ok := repos[e.Repository]
+		if !ok {
+			repo = &htmlRepository{Repository: e.Repository}
+			repos[e.Repository] = repo
+		}
+		repo.Tags++
+		switch e.Status {
+		case StatusInUse:
+			repo.Used += e.Size
+		case StatusDelete:
+			repo.Unused += e.Size
+			repo.Delete++
+		default:
+			repo.Unused += e.Size
+		}
+
+		if e.Created.IsZero() {
+			continue
+		}
+		age := r.Created.Sub(e.Created)
+		for i, b := range ageBuckets {
+			if b.Max == 0 || age < b.Max {
+				buckets[i].Counts[e.Status]++
+				buckets[i].Total++
+				break
+			}
+		}
+	}
+
+	largest := 0
+	for _, b := range buckets {
+		if b.Total > largest {
+			largest = b.Total
+		}
+	}
+	for _, b := range buckets {
+		for _, status := range statuses {
+			if largest > 0 {
+				b.Percent[status] = float64(b.Counts[status]) * 100 / float64(largest)
+			}
+		}
+	}
+	data.Histogram = buckets
+
+	for _, repo := range repos {
+		repo.Logical = r.RepositorySpace[repo.Repository].Logical
+		repo.Reclaimable = r.RepositorySpace[repo.Repository].Reclaimable
+		repo.Approximate = r.RepositorySpace[repo.Repository].Approximate
+		data.Repositories = append(data.Repositories, *repo)
+	}
+	sort.Slice(data.Repositories, func(i, j int) bool {
+		return data.Repositories[i].Reclaimable > data.Repositories[j].Reclaimable
+	})
+
+	for filter, count := range r.Stats {
+		data.FilterStats = append(data.FilterStats, htmlStat{filter, count})
+	}
+	sort.Slice(data.FilterStats, func(i, j int) bool {
+		return data.FilterStats[i].Filter < data.FilterStats[j].Filter
+	})
+
+	return htmlTemplate.Execute(w, data)
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"bytes": humanize.Bytes,
+	"time":  formatTime,
+	"short": shortDigest,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>regclean report for {{ .Registry }}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; text-align: left; }
+th { cursor: pointer; background: #f4f4f4; user-select: none; }
+th.sorted-asc::after { content: " \25B2"; }
+th.sorted-desc::after { content: " \25BC"; }
+td.num { text-align: right; }
+.bar { display: inline-block; height: 1em; vertical-align: middle; }
+.delete { background: #d9534f; }
+.in_use { background: #5cb85c; }
+.kept { background: #5bc0de; }
+.error { background: #f0ad4e; }
+.legend span { margin-right: 1em; }
+.warning { padding: 0.5em 1em; background: #fcf8e3; border: 1px solid #f0ad4e; }
+</style>
+</head>
+<body>
+<h1>regclean report for {{ .Registry }}</h1>
+<p>Generated {{ time .Created }}</p>
+{{- if .FailedContexts }}
+<p class="warning">Images of contexts {{ range $i, $c := .FailedContexts }}{{ if $i }}, {{ end }}{{ $c }}{{ end }} couldn't be fetched, images they use may be listed as unused.</p>
+{{- end }}
+
+<h2>Summary</h2>
+<table class="sortable">
+<thead><tr><th>Status</th><th>Tags</th><th>Size</th></tr></thead>
+<tbody>
+{{- range .Statuses }}
+<tr><td>{{ . }}</td><td class="num">{{ index $.Totals . }}</td><td class="num" data-value="{{ index $.Sizes . }}">{{ bytes (index $.Sizes .) }}</td></tr>
+{{- end }}
+</tbody>
+</table>
+<p>Deleting frees <strong>{{ .Space.ReclaimableBytes }}</strong> of {{ bytes .Space.Logical }} logical size, layers shared with kept images stay.
+{{- if .Space.Approximate }} The registry doesn't report the layers of every image, so layers they share with kept images count as freed.{{ end }}</p>
+
+<h2>Repositories</h2>
+<table class="sortable">
+<thead><tr><th>Repository</th><th>Tags</th><th>Tags to delete</th><th>Used</th><th>Unused</th><th>Deleted (logical)</th><th>Reclaimable</th></tr></thead>
+<tbody>
+{{- range .Repositories }}
+<tr><td>{{ .Repository }}</td><td class="num">{{ .Tags }}</td><td class="num">{{ .Delete }}</td><td class="num" data-value="{{ .Used }}">{{ bytes .Used }}</td><td class="num" data-value="{{ .Unused }}">{{ bytes .Unused }}</td><td class="num" data-value="{{ .Logical }}">{{ bytes .Logical }}</td><td class="num" data-value="{{ .Reclaimable }}">{{ if .Approximate }}~{{ end }}{{ bytes .Reclaimable }}</td></tr>
+{{- end }}
+</tbody>
+</table>
+
+<h2>Tag age</h2>
+<p class="legend">{{ range .Statuses }}<span><span class="bar {{ . }}" style="width: 1em"></span> {{ . }}</span>{{ end }}</p>
+<table>
+<thead><tr><th>Age</th><th>Tags</th><th></th></tr></thead>
+<tbody>
+{{- range .Histogram }}
+{{- $bucket := . }}
+<tr><td>{{ .Label }}</td><td class="num">{{ .Total }}</td><td style="width: 30em">{{ range $.Statuses }}<span class="bar {{ . }}" style="width: {{ printf "%.2f" (index $bucket.Percent .) }}%" title="{{ . }}: {{ index $bucket.Counts . }}"></span>{{ end }}</td></tr>
+{{- end }}
+</tbody>
+</table>
+
+<h2>Filters</h2>
+<table class="sortable">
+<thead><tr><th>Filter</th><th>Tags</th></tr></thead>
+<tbody>
+{{- range .FilterStats }}
+<tr><td>{{ .Filter }}</td><td class="num">{{ .Count }}</td></tr>
+{{- end }}
+</tbody>
+</table>
+
+<h2>Tags</h2>
+<table class="sortable">
+<thead><tr><th>Repository</th><th>Tag</th><th>Digest</th><th>Status</th><th>Why</th><th>Size</th><th>Created</th></tr></thead>
+<tbody>
+{{- range .Entries }}
+<tr><td>{{ .Repository }}</td><td>{{ .Tag }}</td><td title="{{ .Digest }}">{{ short .Digest }}</td><td>{{ .Status }}</td><td>{{ if .Error }}{{ .Error }}{{ else if .Reason }}{{ .Reason }}{{ else }}{{ .Filter }}{{ if .Rule }} ({{ .Rule }}){{ end }}{{ end }}</td><td class="num" data-value="{{ .Size }}">{{ bytes .Size }}</td><td>{{ time .Created }}</td></tr>
+{{- end }}
+</tbody>
+</table>
+
+<script>
+document.querySelectorAll("table.sortable th").forEach(function (th, _, all) {
+  th.addEventListener("click", function () {
+    var table = th.closest("table");
+    var column = Array.prototype.indexOf.call(th.parentNode.children, th);
+    var asc = !th.classList.contains("sorted-asc");
+    th.parentNode.querySelectorAll("th").forEach(function (h) { h.classList.remove("sorted-asc", "sorted-desc"); });
+    th.classList.add(asc ? "sorted-asc" : "sorted-desc");
+    var value = function (row) {
+      var cell = row.children[column];
+      var v = cell.dataset.value !== undefined ? cell.dataset.value : cell.textContent;
+      return isNaN(v) || v === "" ? v.toLowerCase() : parseFloat(v);
+    };
+    var body = table.tBodies[0];
+    Array.from(body.rows).sort(function (a, b) {
+      var x = value(a), y = value(b);
+      return (x < y ? -1 : x > y ? 1 : 0) * (asc ? 1 : -1);
+    }).forEach(function (row) { body.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,39 @@
+package ui
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestReportWriteHTML(t *testing.T) {
+	var out bytes.Buffer
+	if err := testReport().WriteHTML(&out); err != nil {
+		t.Fatal(err)
+	}
+	html := out.String()
+
+	for _, want := range []string{
+		// Repositories, the most reclaimable first.
+		`<tr><td>app</td><td class="num">3</td><td class="num">1</td><td class="num" data-value="2000">2.0 kB</td><td class="num" data-value="3000">3.0 kB</td><td class="num" data-value="1000">1.0 kB</td><td class="num" data-value="700">700 B</td></tr>
+<tr><td>web</td><td class="num">2</td><td class="num">1</td><td class="num" data-value="0">0 B</td><td class="num" data-value="500">500 B</td><td class="num" data-value="500">500 B</td><td class="num" data-value="500">~500 B</td></tr>`,
+		// Tag ages, the error without a creation date is left out.
+		`<tr><td>&lt; 1 week</td><td class="num">2</td>`,
+		`<span class="bar in_use" style="width: 50.00%" title="in_use: 1"></span><span class="bar kept" style="width: 50.00%" title="kept: 1"></span>`,
+		`<tr><td>1 week - 1 month</td><td class="num">0</td>`,
+		`<tr><td>1 - 3 months</td><td class="num">1</td><td style="width: 30em"><span class="bar delete" style="width: 50.00%" title="delete: 1">`,
+		`<tr><td>&gt; 1 year</td><td class="num">1</td>`,
+		// Filters.
+		`<tr><td>exclude_tag</td><td class="num">1</td></tr>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML doesn't contain %s", want)
+		}
+	}
+
+	// The report must open without a network, so nothing is loaded.
+	if external := regexp.MustCompile(`(?i)\b(src|href)\s*=|url\(|@import`).FindAllString(html, -1); len(external) > 0 {
+		t.Errorf("HTML references external assets: %v", external)
+	}
+}
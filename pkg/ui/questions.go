@@ -3,20 +3,29 @@ package ui
 import (
 	"bufio"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"strings"
 )
 
-func YesNo(s string) bool {
-	reader := bufio.NewReader(os.Stdin)
+// Prompts go to stderr, so they don't end up in reports written to stdout.
+// Answers are read through one reader, a reader per question could swallow
+// the answers to the next ones.
+var (
+	prompts io.Writer = os.Stderr
+	answers           = bufio.NewReader(os.Stdin)
+)
 
+// YesNo asks s and tells whether it was answered with yes. Without an answer,
+// like when stdin is closed, the answer is no.
+func YesNo(s string) bool {
 	for {
-		fmt.Printf("%s [N/y]: ", s)
+		fmt.Fprintf(prompts, "%s [N/y]: ", s)
 
-		response, err := reader.ReadString('\n')
+		response, err := answers.ReadString('\n')
 		if err != nil {
-			log.Fatal(err)
+			fmt.Fprintln(prompts)
+			return false
 		}
 
 		response = strings.ToLower(strings.TrimSpace(response))
@@ -0,0 +1,32 @@
+package ui
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestYesNo(t *testing.T) {
+	defaultPrompts, defaultAnswers := prompts, answers
+	t.Cleanup(func() { prompts, answers = defaultPrompts, defaultAnswers })
+
+	var out bytes.Buffer
+	prompts = &out
+	answers = bufio.NewReader(strings.NewReader("y\nmaybe\nNo\n\nyes\ny"))
+
+	got := []bool{}
+	for i := 0; i < 5; i++ {
+		got = append(got, YesNo("Delete?"))
+	}
+	// The last answer is cut off, which counts as no.
+	want := []bool{true, false, false, true, false}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("answer %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if prompts := strings.Count(out.String(), "Delete? [N/y]: "); prompts != 6 {
+		t.Errorf("asked %d times, want 6", prompts)
+	}
+}
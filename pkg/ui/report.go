@@ -1,43 +1,205 @@
 package ui
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/rodaine/table"
 )
 
+const (
+	StatusDelete = "delete"
+	StatusInUse  = "in_use"
+	StatusKept   = "kept"
+	StatusError  = "error"
+)
+
+// Report is the decision regclean made for every image of a run.
+type Report struct {
+	Registry string         `json:"registry"`
+	Created  time.Time      `json:"created"`
+	Entries  []ReportEntry  `json:"entries"`
+	Stats    map[string]int `json:"stats"`
+	// Space is what deleting frees, in total and by repository.
+	Space           Space            `json:"space"`
+	RepositorySpace map[string]Space `json:"repository_space"`
+	// FailedContexts are the Kubernetes contexts whose images couldn't be
+	// fetched, so images they use may show up as unused.
+	FailedContexts []string `json:"failed_contexts,omitempty"`
+}
+
+// Space is the space taken by deleted manifests. Logical counts shared blobs
+// for every manifest, Reclaimable only counts blobs nothing kept references.
+type Space struct {
+	Logical     uint64 `json:"logical"`
+	Reclaimable uint64 `json:"reclaimable"`
+	// Approximate is set when the registry doesn't report the layers of
+	// some images, whose whole size then counts as reclaimable.
+	Approximate bool `json:"approximate,omitempty"`
+}
+
+// ReclaimableBytes formats Reclaimable, marking approximate figures with ~.
+func (s Space) ReclaimableBytes() string {
+	if s.Approximate {
+		return "~" + humanize.Bytes(s.Reclaimable)
+	}
+	return humanize.Bytes(s.Reclaimable)
+}
+
+// ReportEntry is the decision for a single image. Filter names the filter
+// that kept the image, Error is set when its metadata couldn't be fetched.
+type ReportEntry struct {
+	Image      string    `json:"image"`
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Digest     string    `json:"digest,omitempty"`
+	Status     string    `json:"status"`
+	Filter     string    `json:"filter,omitempty"`
+	Rule       string    `json:"rule,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Size       uint64    `json:"size"`
+	Created    time.Time `json:"created"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Formats lists the formats Write supports.
+var Formats = []string{"json", "csv", "markdown", "table"}
+
+// Write renders the report to w in format.
+func (r Report) Write(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "csv":
+		return r.writeCSV(w)
+	case "markdown":
+		return r.writeMarkdown(w)
+	case "table":
+		PrintCountByRepository(w, r)
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q, expected one of %s", format, strings.Join(Formats, ", "))
+}
+
+func (r Report) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"image", "repository", "tag", "digest", "status", "filter", "rule", "reason", "size", "created", "error"}); err != nil {
+		return err
+	}
+	for _, e := range r.Entries {
+		if err := cw.Write([]string{
+			e.Image, e.Repository, e.Tag, e.Digest, e.Status, e.Filter, e.Rule, e.Reason,
+			strconv.FormatUint(e.Size, 10), formatTime(e.Created), e.Error,
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r Report) writeMarkdown(w io.Writer) error {
+	type total struct {
+		count int
+		size  uint64
+	}
+	totals := map[string]*total{}
+	for _, status := range []string{StatusDelete, StatusInUse, StatusKept, StatusError} {
+		totals[status] = &total{}
+	}
+	for _, e := range r.Entries {
+		totals[e.Status].count++
+		totals[e.Status].size += e.Size
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "## regclean report for %s\n\n", r.Registry)
+	if len(r.FailedContexts) > 0 {
+		fmt.Fprintf(b, "**Images of contexts %s couldn't be fetched, images they use may be listed as unused.**\n\n", strings.Join(r.FailedContexts, ", "))
+	}
+	fmt.Fprintf(b, "| Status | Images | Size |\n|---|---:|---:|\n")
+	for _, status := range []string{StatusDelete, StatusInUse, StatusKept, StatusError} {
+		fmt.Fprintf(b, "| %s | %d | %s |\n", status, totals[status].count, humanize.Bytes(totals[status].size))
+	}
+	fmt.Fprintf(b, "\nDeleting frees **%s** of %s logical size, layers shared with kept images stay.\n",
+		r.Space.ReclaimableBytes(), humanize.Bytes(r.Space.Logical))
+	if r.Space.Approximate {
+		fmt.Fprintf(b, "\nThe registry doesn't report the layers of every image, so layers they share with kept images count as freed.\n")
+	}
+	fmt.Fprintf(b, "\n| Image | Digest | Status | Why | Size | Created |\n|---|---|---|---|---:|---|\n")
+	for _, e := range r.Entries {
+		why := e.Filter
+		switch {
+		case e.Error != "":
+			why = e.Error
+		case e.Reason != "":
+			why = e.Reason
+		case e.Rule != "":
+			why = strings.TrimSpace(why + " (" + e.Rule + ")")
+		}
+		digest := ""
+		if e.Digest != "" {
+			digest = "`" + shortDigest(e.Digest) + "`"
+		}
+		fmt.Fprintf(b, "| `%s` | %s | %s | %s | %s | %s |\n",
+			e.Image, digest, e.Status, markdownEscape(why), humanize.Bytes(e.Size), formatTime(e.Created))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
 type RepoCount struct {
-	Registry   string
-	Repository string
-	Count      int
+	Registry    string
+	Repository  string
+	Count       int
+	Size        uint64
+	DeleteCount int
 }
 
-func PrintCountByRepository(images []string) {
+// PrintCountByRepository prints the number and size of the images of every
+// repository, and how much of that is deleted and really freed.
+func PrintCountByRepository(w io.Writer, r Report) {
 	counts := map[string]RepoCount{}
 
-	tbl := table.New("Registry", "Repository", "Count")
-	for _, image := range images {
-		reg, repo, _ := splitImageTag(image)
-		if entry, ok := counts[reg+"|"+repo]; ok {
-			entry.Count = entry.Count + 1
-			counts[reg+"|"+repo] = entry
-
-		} else {
-			counts[reg+"|"+repo] = RepoCount{
+	table.DefaultHeaderFormatter = func(format string, vals ...interface{}) string {
+		return strings.ToUpper(fmt.Sprintf(format, vals...))
+	}
+	tbl := table.New("Registry", "Repository", "Count", "Size", "Delete", "Logical", "Reclaimable").WithWriter(w)
+	for _, e := range r.Entries {
+		reg, repo, _ := splitImageTag(e.Image)
+		entry, ok := counts[reg+"|"+repo]
+		if !ok {
+			entry = RepoCount{
 				Registry:   reg,
 				Repository: repo,
-				Count:      1,
 			}
 		}
+		entry.Count++
+		entry.Size += e.Size
+		if e.Status == StatusDelete {
+			entry.DeleteCount++
+		}
+		counts[reg+"|"+repo] = entry
 	}
 
-	table.DefaultHeaderFormatter = func(format string, vals ...interface{}) string {
-		return strings.ToUpper(fmt.Sprintf(format, vals...))
+	keys := []string{}
+	for key := range counts {
+		keys = append(keys, key)
 	}
-
-	for _, c := range counts {
-		tbl.AddRow(c.Registry, c.Repository, c.Count)
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := counts[key]
+		space := r.RepositorySpace[c.Repository]
+		tbl.AddRow(c.Registry, c.Repository, c.Count, humanize.Bytes(c.Size), c.DeleteCount, humanize.Bytes(space.Logical), space.ReclaimableBytes())
 	}
 
 	tbl.Print()
@@ -48,3 +210,21 @@ func splitImageTag(image string) (string, string, string) {
 	i := strings.SplitN(r[1], ":", 2)
 	return r[0], i[0], i[1]
 }
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func shortDigest(digest string) string {
+	if _, hex, ok := strings.Cut(digest, ":"); ok && len(hex) > 12 {
+		return digest[:len(digest)-len(hex)+12]
+	}
+	return digest
+}
+
+func markdownEscape(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
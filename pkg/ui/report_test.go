@@ -0,0 +1,120 @@
+package ui
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testReport() Report {
+	created := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	return Report{
+		Registry: "registry.test",
+		Created:  created,
+		Entries: []ReportEntry{
+			{Image: "registry.test/app:1.0", Repository: "app", Tag: "1.0", Digest: "sha256:0123456789abcdef", Status: StatusDelete, Reason: "not in use, older than 30 days", Size: 1000, Created: created.AddDate(0, -2, 0)},
+			{Image: "registry.test/app:2.0", Repository: "app", Tag: "2.0", Digest: "sha256:fedcba9876543210", Status: StatusInUse, Size: 2000, Created: created.AddDate(0, 0, -1)},
+			{Image: "registry.test/app:latest", Repository: "app", Tag: "latest", Status: StatusKept, Filter: "exclude_tag", Rule: "releases", Size: 2000, Created: created.AddDate(0, 0, -1)},
+			{Image: "registry.test/web:1.0", Repository: "web", Tag: "1.0", Status: StatusError, Error: "GET manifest: 401 | denied"},
+			{Image: "registry.test/web:0.9", Repository: "web", Tag: "0.9", Digest: "sha256:aaaa", Status: StatusDelete, Size: 500, Created: created.AddDate(-2, 0, 0)},
+		},
+		Stats:           map[string]int{"delete": 2, "exclude_tag": 1, "error": 1},
+		Space:           Space{Logical: 1500, Reclaimable: 1200},
+		RepositorySpace: map[string]Space{"app": {Logical: 1000, Reclaimable: 700}, "web": {Logical: 500, Reclaimable: 500, Approximate: true}},
+	}
+}
+
+func TestReportWrite(t *testing.T) {
+	r := testReport()
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := r.Write(&out, "json"); err != nil {
+			t.Fatal(err)
+		}
+		got := Report{}
+		if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, r) {
+			t.Errorf("decoded report = %+v, want %+v", got, r)
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := r.Write(&out, "csv"); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := csv.NewReader(&out).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != len(r.Entries)+1 {
+			t.Fatalf("%d rows, want a header and %d entries", len(rows), len(r.Entries))
+		}
+		header := "image,repository,tag,digest,status,filter,rule,reason,size,created,error"
+		if strings.Join(rows[0], ",") != header {
+			t.Errorf("header = %v, want %s", rows[0], header)
+		}
+		want := []string{"registry.test/app:latest", "app", "latest", "", "kept", "exclude_tag", "releases", "", "2000", "2023-05-31T00:00:00Z", ""}
+		if !reflect.DeepEqual(rows[3], want) {
+			t.Errorf("row = %q, want %q", rows[3], want)
+		}
+	})
+
+	t.Run("markdown", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := r.Write(&out, "markdown"); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"| delete | 2 | 1.5 kB |",
+			"| in_use | 1 | 2.0 kB |",
+			"Deleting frees **1.2 kB** of 1.5 kB logical size",
+			"| `registry.test/app:latest` |  | kept | exclude_tag (releases) | 2.0 kB | 2023-05-31T00:00:00Z |",
+			"| `registry.test/app:1.0` | `sha256:0123456789ab` | delete |",
+			`GET manifest: 401 \| denied`,
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("markdown doesn't contain %q:\n%s", want, out.String())
+			}
+		}
+		// Every table row has the same number of unescaped cell separators.
+		for _, line := range strings.Split(out.String(), "\n") {
+			if strings.HasPrefix(line, "| `") && strings.Count(strings.ReplaceAll(line, `\|`, ""), "|") != 7 {
+				t.Errorf("row has extra cells: %s", line)
+			}
+		}
+	})
+
+	t.Run("table", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := r.Write(&out, "table"); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("table has %d lines, want a header and 2 repositories:\n%s", len(lines), out.String())
+		}
+		for i, want := range [][]string{
+			{"REGISTRY", "REPOSITORY", "COUNT", "SIZE", "DELETE", "LOGICAL", "RECLAIMABLE"},
+			{"registry.test", "app", "3", "5.0", "kB", "1", "1.0", "kB", "700", "B"},
+			{"registry.test", "web", "2", "500", "B", "1", "500", "B", "~500", "B"},
+		} {
+			if got := strings.Fields(lines[i]); !reflect.DeepEqual(got, want) {
+				t.Errorf("line %d = %q, want %q", i, got, want)
+			}
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if err := r.Write(&bytes.Buffer{}, "xml"); err == nil {
+			t.Errorf("Write() of an unknown format, want an error")
+		}
+	})
+}